@@ -63,6 +63,7 @@ type FingerprintResponse struct {
 	IP        string `json:"ip""`
 	UserAgent string `json:"useragent"`
 
+	ASN           uint    `json:"asn"`
 	ASNName       string  `json:"asnName"`
 	ASNNetwork    string  `json:"asnNetwork"`
 	ContinentCode string  `json:"continentCode"`
@@ -181,6 +182,7 @@ func getUserIpInformation(cityDBReader, asnDBReader *maxminddb.Reader, clientIp
 	var asnRecord ASNRecord
 	err = asnDBReader.Lookup(clientIp, &asnRecord)
 	if err == nil {
+		response.ASN = asnRecord.AutonomousSystemNumber
 		response.ASNName = asnRecord.AutonomousSystemOrganization
 	}
 	return response
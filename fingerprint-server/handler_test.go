@@ -41,6 +41,7 @@ func Test_getUserIpInformation(t *testing.T) {
 		}{clientIp: net.ParseIP("70.53.250.221"), userAgent: "curl/8.6.0"}, want: FingerprintResponse{
 			IP:            "70.53.250.221",
 			UserAgent:     "curl/8.6.0",
+			ASN:           577,
 			ASNName:       "BACOM",
 			ASNNetwork:    "70.53.250.0/24",
 			ContinentCode: "NA",
@@ -58,6 +59,7 @@ func Test_getUserIpInformation(t *testing.T) {
 		}{clientIp: net.ParseIP("2001:4860:4860::8888"), userAgent: "curl/8.6.0"}, want: FingerprintResponse{
 			IP:            "2001:4860:4860::8888",
 			UserAgent:     "curl/8.6.0",
+			ASN:           15169,
 			ASNName:       "GOOGLE",
 			ASNNetwork:    "2001:4860:4800::/37",
 			ContinentCode: "NA",
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"github.com/oschwald/maxminddb-golang"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/viper"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"proxy/collector"
+	"proxy/utils"
+	"syscall"
+	"time"
 )
 
 var requestCounter prometheus.Counter
@@ -28,6 +34,14 @@ func main() {
 	viper.BindEnv("enablePrometheusMetric", "ENABLE_PROMETHEUS_METRIC")
 	viper.BindEnv("metricPort", "METRIC_PORT")
 
+	viper.SetDefault("enableReadiness", true)
+	viper.SetDefault("shutdownTimeout", 30*time.Second)
+
+	viper.BindEnv("enableReadiness", "ENABLE_READINESS")
+	viper.BindEnv("shutdownTimeout", "SHUTDOWN_TIMEOUT")
+
+	readiness := &utils.Readiness{}
+
 	if viper.GetBool("enablePrometheusMetric") {
 		requestCounter = prometheus.NewCounter(prometheus.CounterOpts{
 			Namespace: "scrapoxy",
@@ -44,6 +58,13 @@ func main() {
 		}
 		prometheus.MustRegister(collector.NewPrometheusMetrics(c, extraCollector))
 		http.Handle("/metrics", promhttp.Handler())
+	}
+
+	if viper.GetBool("enableReadiness") {
+		http.Handle("/ready", readiness)
+	}
+
+	if viper.GetBool("enablePrometheusMetric") || viper.GetBool("enableReadiness") {
 		log.Printf("Starting metric server on %s\n", viper.GetString("metricPort"))
 		go http.ListenAndServe(viper.GetString("metricPort"), nil)
 	}
@@ -66,10 +87,32 @@ func main() {
 	mux.HandleFunc("/", handler.Handle404Request)
 	mux.HandleFunc("/api/json", handler.HandleJsonAPIRequest)
 
+	server := http.Server{
+		Addr:    viper.GetString("fingerprintServerPort"),
+		Handler: mux,
+	}
+
+	signalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
 	// Start the server and log any errors
-	log.Printf("Starting fingerprint-server server on %s\n", viper.GetString("fingerprintServerPort"))
-	err = http.ListenAndServe(viper.GetString("fingerprintServerPort"), mux)
-	if err != nil {
-		log.Fatal("Error starting fingerprint-server server: ", err)
+	go func() {
+		log.Printf("Starting fingerprint-server server on %s\n", viper.GetString("fingerprintServerPort"))
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal("Error starting fingerprint-server server: ", err)
+		}
+	}()
+
+	<-signalCtx.Done()
+	stop()
+	log.Printf("Draining connections for up to %s\n", viper.GetDuration("shutdownTimeout"))
+	readiness.SetDraining()
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), viper.GetDuration("shutdownTimeout"))
+	defer cancelShutdown()
+	if err = server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Could not drain fingerprint-server server: %s\n", err)
 	}
+	log.Println("Fingerprint-server server stopped")
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBanBodyBytes is how much of a response body the ban rules can match. The body is
+// held back from the client until then.
+const maxBanBodyBytes = 64 * 1024
+
+// maxCooldownDomains triggers a purge of the expired cooldowns past that many domains.
+const maxCooldownDomains = 10000
+
+// BanRules tell the responses that mean the target banned the proxy. A response matching
+// any rule is a ban.
+type BanRules struct {
+	StatusCodes []int `bson:"statusCodes"`
+	// Headers maps header names to regular expressions matched against their values.
+	Headers map[string]string `bson:"headers"`
+	// BodyPattern is a regular expression matched against the start of the body, as the
+	// target sent it: a compressed body does not match.
+	BodyPattern string `bson:"bodyPattern"`
+	// Cooldown is how long, in seconds, a banned proxy is not picked for the domain. The
+	// dispatcher default applies when it is 0.
+	Cooldown int `bson:"cooldown"`
+}
+
+// targetDomain returns the lowercase host name of a host:port target.
+func targetDomain(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// DomainCooldowns keeps the proxies banned by a domain away from the selections for that
+// domain until their cooldown ends.
+type DomainCooldowns struct {
+	mutex sync.Mutex
+	until map[string]map[string]time.Time
+}
+
+func NewDomainCooldowns() *DomainCooldowns {
+	return &DomainCooldowns{until: make(map[string]map[string]time.Time)}
+}
+
+// Add cools the proxy down for the domain.
+func (c *DomainCooldowns) Add(proxyID, domain string, cooldown time.Duration) {
+	now := time.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.until) >= maxCooldownDomains {
+		for d := range c.until {
+			c.purge(d, now)
+		}
+	}
+	proxies, ok := c.until[domain]
+	if !ok {
+		proxies = make(map[string]time.Time)
+		c.until[domain] = proxies
+	}
+	proxies[proxyID] = now.Add(cooldown)
+}
+
+// Excluded returns the proxies cooling down for the domain of the query.
+func (c *DomainCooldowns) Excluded(project Project, query ProxyQuery) []string {
+	if query.Domain == "" {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.purge(query.Domain, time.Now())
+	var excluded []string
+	for proxyID := range c.until[query.Domain] {
+		excluded = append(excluded, proxyID)
+	}
+	return excluded
+}
+
+// purge forgets the cooldowns of the domain that ended.
+func (c *DomainCooldowns) purge(domain string, now time.Time) {
+	for proxyID, until := range c.until[domain] {
+		if now.After(until) {
+			delete(c.until[domain], proxyID)
+		}
+	}
+	if len(c.until[domain]) == 0 {
+		delete(c.until, domain)
+	}
+}
+
+// BanMiddleware matches the responses against the ban rules of the project. On a ban, the
+// proxy cools down for the domain of the target and the tunnel is closed after the
+// response, so that the next request of the client goes through another proxy.
+type BanMiddleware struct {
+	cooldowns       *DomainCooldowns
+	domains         *LabelLimiter
+	defaultCooldown time.Duration
+	patterns        sync.Map
+}
+
+func NewBanMiddleware(cooldowns *DomainCooldowns, domains *LabelLimiter, defaultCooldown time.Duration) *BanMiddleware {
+	return &BanMiddleware{cooldowns: cooldowns, domains: domains, defaultCooldown: defaultCooldown}
+}
+
+func (m *BanMiddleware) HandleRequest(*Exchange) *ProxyError {
+	return nil
+}
+
+func (m *BanMiddleware) HandleResponse(ex *Exchange) *ProxyError {
+	rules := ex.Project.BanRules
+	if rules == nil || ex.Proxy == nil || !m.banned(rules, ex) {
+		return nil
+	}
+
+	domain := targetDomain(ex.Host)
+	cooldown := m.defaultCooldown
+	if rules.Cooldown > 0 {
+		cooldown = time.Duration(rules.Cooldown) * time.Second
+	}
+	log.Printf("Proxy %s is banned by %s, cooling down for %s\n", ex.Proxy.ID, domain, cooldown)
+	m.cooldowns.Add(ex.Proxy.ID, domain, cooldown)
+	bansDetectedCounter.WithLabelValues(m.domains.Value(domain)).Inc()
+	ex.Response.Close = true
+	return nil
+}
+
+func (m *BanMiddleware) banned(rules *BanRules, ex *Exchange) bool {
+	resp := ex.Response
+	if slices.Contains(rules.StatusCodes, resp.StatusCode) {
+		return true
+	}
+	for name, pattern := range rules.Headers {
+		re := m.compile(pattern)
+		for _, value := range resp.Header.Values(name) {
+			if re != nil && re.MatchString(value) {
+				return true
+			}
+		}
+	}
+	if re := m.compile(rules.BodyPattern); re != nil {
+		// The start of the body is read for the match and put back for the client.
+		start, err := io.ReadAll(io.LimitReader(resp.Body, maxBanBodyBytes))
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(start), resp.Body), resp.Body}
+		if err == nil && re.Match(start) {
+			return true
+		}
+	}
+	return false
+}
+
+// compile returns the compiled pattern, nil when it is empty or invalid. The patterns are
+// compiled once.
+func (m *BanMiddleware) compile(pattern string) *regexp.Regexp {
+	if pattern == "" {
+		return nil
+	}
+	if re, ok := m.patterns.Load(pattern); ok {
+		return re.(*regexp.Regexp)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Printf("Invalid ban pattern %q: %s\n", pattern, err)
+	}
+	m.patterns.Store(pattern, re)
+	return re
+}
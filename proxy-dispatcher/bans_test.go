@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDomainCooldowns_Excluded(t *testing.T) {
+	cooldowns := NewDomainCooldowns()
+	cooldowns.Add("a", "example.com", time.Minute)
+	cooldowns.Add("b", "example.com", -time.Second)
+
+	if got := cooldowns.Excluded(Project{}, ProxyQuery{Domain: "example.com"}); len(got) != 1 || got[0] != "a" {
+		t.Errorf("Excluded(example.com) = %v, want [a]", got)
+	}
+	if got := cooldowns.Excluded(Project{}, ProxyQuery{Domain: "example.org"}); len(got) != 0 {
+		t.Errorf("Excluded(example.org) = %v, want none", got)
+	}
+	if got := cooldowns.Excluded(Project{}, ProxyQuery{}); len(got) != 0 {
+		t.Errorf("Excluded() = %v, want none", got)
+	}
+}
+
+func TestBanMiddleware_HandleResponse(t *testing.T) {
+	bansDetectedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "bans_detected"}, []string{"domain"})
+	rules := &BanRules{
+		StatusCodes: []int{429},
+		Headers:     map[string]string{"Server": "^guard"},
+		BodyPattern: "captcha",
+	}
+	tests := []struct {
+		name   string
+		status int
+		header string
+		body   string
+		want   bool
+	}{
+		{"ok", 200, "nginx", "hello", false},
+		{"status", 429, "nginx", "", true},
+		{"header", 200, "guard/1.0", "", true},
+		{"body", 200, "nginx", "solve this captcha", true},
+	}
+	for _, tt := range tests {
+		cooldowns := NewDomainCooldowns()
+		middleware := NewBanMiddleware(cooldowns, NewLabelLimiter(nil, 0), time.Minute)
+		resp := &http.Response{
+			StatusCode: tt.status,
+			Header:     http.Header{"Server": {tt.header}},
+			Body:       io.NopCloser(strings.NewReader(tt.body)),
+		}
+		ex := &Exchange{Project: Project{BanRules: rules}, Proxy: &Proxy{ID: "p"}, Host: "Example.com:443", Response: resp}
+		middleware.HandleResponse(ex)
+
+		banned := len(cooldowns.Excluded(Project{}, ProxyQuery{Domain: "example.com"})) > 0
+		if banned != tt.want || resp.Close != tt.want {
+			t.Errorf("%s: banned, Close = %t, %t, want %t", tt.name, banned, resp.Close, tt.want)
+		}
+		if body, _ := io.ReadAll(resp.Body); string(body) != tt.body {
+			t.Errorf("%s: body = %q, want %q", tt.name, body, tt.body)
+		}
+	}
+}
@@ -8,19 +8,34 @@ import (
 
 type Collector struct {
 	repo    Repository
+	health  *ProxyHealth
 	metrics map[string]collector.MetricInfo
 }
 
-func NewCollector(repo Repository, namespace, subsystem string) Collector {
+func NewCollector(repo Repository, health *ProxyHealth, namespace, subsystem string) Collector {
 	return Collector{
-		repo: repo,
+		repo:   repo,
+		health: health,
 		metrics: map[string]collector.MetricInfo{
-			"proxy_status":   collector.NewMetric(namespace, subsystem, "proxy_status", "", prometheus.GaugeValue, nil, []string{"status"}),
-			"proxy_count":    collector.NewMetric(namespace, subsystem, "proxy_count", "", prometheus.GaugeValue, nil, []string{"removing"}),
-			"requests_count": collector.NewMetric(namespace, subsystem, "requests_count", "", prometheus.CounterValue, nil, []string{}),
-			"errors_count":   collector.NewMetric(namespace, subsystem, "errors_count", "", prometheus.CounterValue, nil, []string{}),
-			"bytes_received": collector.NewMetric(namespace, subsystem, "bytes_received", "", prometheus.CounterValue, nil, []string{}),
-			"bytes_sent":     collector.NewMetric(namespace, subsystem, "bytes_sent", "", prometheus.CounterValue, nil, []string{}),
+			"proxy_status":            collector.NewMetric(namespace, subsystem, "proxy_status", "", prometheus.GaugeValue, nil, []string{"status"}),
+			"proxy_count":             collector.NewMetric(namespace, subsystem, "proxy_count", "", prometheus.GaugeValue, nil, []string{"removing"}),
+			"requests_count":          collector.NewMetric(namespace, subsystem, "requests_count", "", prometheus.CounterValue, nil, []string{}),
+			"errors_count":            collector.NewMetric(namespace, subsystem, "errors_count", "", prometheus.CounterValue, nil, []string{}),
+			"bytes_received":          collector.NewMetric(namespace, subsystem, "bytes_received", "", prometheus.CounterValue, nil, []string{}),
+			"bytes_sent":              collector.NewMetric(namespace, subsystem, "bytes_sent", "", prometheus.CounterValue, nil, []string{}),
+			"connect_retries":         collector.NewMetric(namespace, subsystem, "connect_retries", "", prometheus.CounterValue, nil, []string{"code"}),
+			"rejected_count":          collector.NewMetric(namespace, subsystem, "rejected_count", "", prometheus.CounterValue, nil, []string{"project", "code"}),
+			"tunnels_count":           collector.NewMetric(namespace, subsystem, "tunnels_count", "", prometheus.CounterValue, nil, []string{"project", "proxy", "host_class", "outcome"}),
+			"tunnel_bytes_received":   collector.NewMetric(namespace, subsystem, "tunnel_bytes_received", "", prometheus.CounterValue, nil, []string{"project", "proxy", "host_class"}),
+			"tunnel_bytes_sent":       collector.NewMetric(namespace, subsystem, "tunnel_bytes_sent", "", prometheus.CounterValue, nil, []string{"project", "proxy", "host_class"}),
+			"tunnel_size_bytes":       collector.NewMetric(namespace, subsystem, "tunnel_size_bytes", "", prometheus.UntypedValue, nil, []string{"project", "host_class"}),
+			"proxy_dial_seconds":      collector.NewMetric(namespace, subsystem, "proxy_dial_seconds", "", prometheus.UntypedValue, nil, []string{}),
+			"proxy_connect_seconds":   collector.NewMetric(namespace, subsystem, "proxy_connect_seconds", "", prometheus.UntypedValue, nil, []string{}),
+			"first_byte_seconds":      collector.NewMetric(namespace, subsystem, "first_byte_seconds", "", prometheus.UntypedValue, nil, []string{}),
+			"tunnel_duration_seconds": collector.NewMetric(namespace, subsystem, "tunnel_duration_seconds", "", prometheus.UntypedValue, nil, []string{}),
+			"bans_detected":           collector.NewMetric(namespace, subsystem, "bans_detected", "", prometheus.CounterValue, nil, []string{"domain"}),
+			"quarantined_count":       collector.NewMetric(namespace, subsystem, "quarantined_count", "", prometheus.GaugeValue, nil, []string{}),
+			"proxy_quarantined":       collector.NewMetric(namespace, subsystem, "proxy_quarantined", "", prometheus.GaugeValue, nil, []string{"proxy"}),
 		},
 	}
 }
@@ -49,6 +64,29 @@ func (c Collector) CollectStats() map[string]map[string]collector.MetricValue {
 
 	stats["bytes_received"] = map[string]collector.MetricValue{"default": collector.MetricValue{Collector: bytesReceivedCounter.Collect}}
 	stats["bytes_sent"] = map[string]collector.MetricValue{"default": collector.MetricValue{Collector: bytesSentCounter.Collect}}
+	stats["connect_retries"] = map[string]collector.MetricValue{"default": collector.MetricValue{Collector: retryCounter.Collect}}
+	stats["rejected_count"] = map[string]collector.MetricValue{"default": collector.MetricValue{Collector: rejectedCounter.Collect}}
+
+	stats["tunnels_count"] = map[string]collector.MetricValue{"default": collector.MetricValue{Collector: tunnelCounter.Collect}}
+	stats["tunnel_bytes_received"] = map[string]collector.MetricValue{"default": collector.MetricValue{Collector: tunnelBytesReceivedCounter.Collect}}
+	stats["tunnel_bytes_sent"] = map[string]collector.MetricValue{"default": collector.MetricValue{Collector: tunnelBytesSentCounter.Collect}}
+	stats["tunnel_size_bytes"] = map[string]collector.MetricValue{"default": collector.MetricValue{Collector: tunnelSizeHistogram.Collect}}
+
+	stats["proxy_dial_seconds"] = map[string]collector.MetricValue{"default": collector.MetricValue{Collector: proxyDialHistogram.Collect}}
+	stats["proxy_connect_seconds"] = map[string]collector.MetricValue{"default": collector.MetricValue{Collector: proxyConnectHistogram.Collect}}
+	stats["first_byte_seconds"] = map[string]collector.MetricValue{"default": collector.MetricValue{Collector: firstByteHistogram.Collect}}
+	stats["tunnel_duration_seconds"] = map[string]collector.MetricValue{"default": collector.MetricValue{Collector: tunnelDurationHistogram.Collect}}
+
+	stats["bans_detected"] = map[string]collector.MetricValue{"default": collector.MetricValue{Collector: bansDetectedCounter.Collect}}
+
+	quarantined := c.health.Quarantined()
+	stats["quarantined_count"] = map[string]collector.MetricValue{"default": collector.MetricValue{Value: int64(len(quarantined))}}
+	for _, id := range quarantined {
+		if stats["proxy_quarantined"] == nil {
+			stats["proxy_quarantined"] = make(map[string]collector.MetricValue)
+		}
+		stats["proxy_quarantined"][id] = collector.MetricValue{Value: 1, Labels: []string{id}}
+	}
 
 	return stats
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+// Credentials holds what a client sent to authenticate: the project token and the
+// options it appended to the username, like "<username>-session-<id>" or
+// "<username>-country-<code>".
+type Credentials struct {
+	Token   string
+	Session string
+	Geo     GeoQuery
+}
+
+// parseBasicCredentials parses the value of a Basic Proxy-Authorization header. The
+// project token is the base64 of "username:password", so the options are removed from
+// the username before the token is encoded again. Values that cannot be decoded are
+// used as the token as is.
+func parseBasicCredentials(encoded string) Credentials {
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return Credentials{Token: encoded}
+	}
+	username, password, found := strings.Cut(string(decoded), ":")
+	if !found {
+		return Credentials{Token: encoded}
+	}
+
+	credentials := parseUsernameOptions(username)
+	if credentials.Token == username {
+		credentials.Token = encoded
+	} else {
+		credentials.Token = base64.StdEncoding.EncodeToString([]byte(credentials.Token + ":" + password))
+	}
+	return credentials
+}
+
+// parseUsernameOptions splits "<username>-<key>-<value>..." into the username, returned
+// as the token, and the known options. A value runs up to the next option, so that it may
+// hold dashes, like the ASN "AMAZON-02".
+func parseUsernameOptions(username string) Credentials {
+	parts := strings.Split(username, "-")
+	var keys []int
+	for i := 1; i < len(parts)-1; i++ {
+		if isUsernameOption(parts[i]) {
+			keys = append(keys, i)
+			// The value holds at least the next part, even when it looks like a key.
+			i++
+		}
+	}
+	if len(keys) == 0 {
+		return Credentials{Token: username}
+	}
+
+	credentials := Credentials{Token: strings.Join(parts[:keys[0]], "-")}
+	for k, i := range keys {
+		end := len(parts)
+		if k+1 < len(keys) {
+			end = keys[k+1]
+		}
+		value := strings.Join(parts[i+1:end], "-")
+		switch parts[i] {
+		case "session":
+			credentials.Session = value
+		case "country":
+			credentials.Geo.Country = value
+		case "continent":
+			credentials.Geo.Continent = value
+		case "asn":
+			credentials.Geo.ASN = value
+		}
+	}
+	return credentials
+}
+
+func isUsernameOption(key string) bool {
+	switch key {
+	case "session", "country", "continent", "asn":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+func Test_parseBasicCredentials(t *testing.T) {
+	encode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	tests := []struct {
+		name    string
+		encoded string
+		want    Credentials
+	}{
+		{name: "plain token", encoded: encode("user:pass"), want: Credentials{Token: encode("user:pass")}},
+		{name: "not base64", encoded: "token", want: Credentials{Token: "token"}},
+		{name: "session", encoded: encode("user-session-abc:pass"), want: Credentials{Token: encode("user:pass"), Session: "abc"}},
+		{name: "dashed username", encoded: encode("my-user-session-abc:pass"), want: Credentials{Token: encode("my-user:pass"), Session: "abc"}},
+		{name: "country", encoded: encode("user-country-CA:pass"), want: Credentials{Token: encode("user:pass"), Geo: GeoQuery{Country: "CA"}}},
+		{name: "geo and session", encoded: encode("user-continent-EU-asn-OVH-session-abc:pass"), want: Credentials{Token: encode("user:pass"), Session: "abc", Geo: GeoQuery{Continent: "EU", ASN: "OVH"}}},
+		{name: "unknown option", encoded: encode("user-foo-bar:pass"), want: Credentials{Token: encode("user-foo-bar:pass")}},
+		{name: "dashed asn", encoded: encode("user-asn-AMAZON-02-session-abc:pass"), want: Credentials{Token: encode("user:pass"), Session: "abc", Geo: GeoQuery{ASN: "AMAZON-02"}}},
+		{name: "dashed asn last", encoded: encode("user-country-US-asn-AMAZON-02:pass"), want: Credentials{Token: encode("user:pass"), Geo: GeoQuery{Country: "US", ASN: "AMAZON-02"}}},
+		{name: "numeric asn", encoded: encode("user-asn-AS16509:pass"), want: Credentials{Token: encode("user:pass"), Geo: GeoQuery{ASN: "AS16509"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseBasicCredentials(tt.encoded); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseBasicCredentials() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGeoQuery_Matches(t *testing.T) {
+	fingerprint := &Fingerprint{CountryCode: "CA", ContinentCode: "NA", ASN: 16276, ASNName: "OVH SAS"}
+	tests := []struct {
+		name  string
+		query GeoQuery
+		want  bool
+	}{
+		{name: "any", query: GeoQuery{}, want: true},
+		{name: "country", query: GeoQuery{Country: "ca"}, want: true},
+		{name: "other country", query: GeoQuery{Country: "US"}, want: false},
+		{name: "continent and asn", query: GeoQuery{Continent: "NA", ASN: "ovh sas"}, want: true},
+		{name: "other asn", query: GeoQuery{Country: "CA", ASN: "OVH"}, want: false},
+		{name: "asn number", query: GeoQuery{ASN: "16276"}, want: true},
+		{name: "asn number with prefix", query: GeoQuery{ASN: "as16276"}, want: true},
+		{name: "other asn number", query: GeoQuery{ASN: "AS16509"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.query.Matches(fingerprint); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	// Without a number in the fingerprint, the name is compared.
+	if (GeoQuery{ASN: "16276"}).Matches(&Fingerprint{ASNName: "OVH SAS"}) {
+		t.Errorf("Matches() = true for a number against a name, want false")
+	}
+	if (GeoQuery{Country: "CA"}).Matches(nil) {
+		t.Errorf("Matches(nil) = true, want false")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Error codes returned to the clients in the X-Scrapoxy-Proxyerror header and in the
+// id field of the error body.
+const (
+	ErrorNoToken           = "no_token"
+	ErrorBadToken          = "bad_token"
+	ErrorNoProject         = "no_project"
+	ErrorNoProxy           = "no_proxy"
+	ErrorNoMatchingProxy   = "no_matching_proxy"
+	ErrorProxyDialFailed   = "proxy_dial_failed"
+	ErrorProxyRefused      = "proxy_refused"
+	ErrorUpstreamTimeout   = "upstream_timeout"
+	ErrorRateLimited       = "rate_limited"
+	ErrorTooManyTunnels    = "too_many_tunnels"
+	ErrorTargetDenied      = "target_denied"
+	ErrorTargetUnreachable = "target_unreachable"
+	ErrorUpstreamTLS       = "upstream_tls_failed"
+)
+
+// defaultRetryAfter is the Retry-After of the 429 and 503 answers whose error does not
+// tell when to retry.
+const defaultRetryAfter = time.Second
+
+var errorStatus = map[string]int{
+	ErrorNoToken:           http.StatusProxyAuthRequired,
+	ErrorBadToken:          http.StatusProxyAuthRequired,
+	ErrorNoProject:         http.StatusProxyAuthRequired,
+	ErrorNoProxy:           http.StatusServiceUnavailable,
+	ErrorNoMatchingProxy:   http.StatusServiceUnavailable,
+	ErrorProxyDialFailed:   http.StatusBadGateway,
+	ErrorProxyRefused:      http.StatusBadGateway,
+	ErrorUpstreamTimeout:   http.StatusGatewayTimeout,
+	ErrorRateLimited:       http.StatusTooManyRequests,
+	ErrorTooManyTunnels:    http.StatusTooManyRequests,
+	ErrorTargetDenied:      http.StatusForbidden,
+	ErrorTargetUnreachable: http.StatusBadGateway,
+	ErrorUpstreamTLS:       http.StatusBadGateway,
+}
+
+// ProxyError is an error the dispatcher reports to its client with a stable code.
+type ProxyError struct {
+	Code    string
+	Message string
+	Err     error
+	// RetryAfter is sent in the Retry-After header when it is set, the 429 and 503 answers
+	// get defaultRetryAfter otherwise.
+	RetryAfter time.Duration
+}
+
+func NewProxyError(code, message string, err error) *ProxyError {
+	return &ProxyError{Code: code, Message: message, Err: err}
+}
+
+func (e *ProxyError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// Status returns the HTTP status matching the error code.
+func (e *ProxyError) Status() int {
+	if status, ok := errorStatus[e.Code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+type errorBody struct {
+	ID      string `json:"id"`
+	Message string `json:"message"`
+	Method  string `json:"method"`
+	URL     string `json:"url"`
+}
+
+// header returns the headers of the answer to the error.
+func (e *ProxyError) header() http.Header {
+	header := make(http.Header)
+	if e.Status() == http.StatusProxyAuthRequired {
+		header.Set("Proxy-Authenticate", "Basic")
+	}
+	retryAfter := e.RetryAfter
+	if status := e.Status(); retryAfter <= 0 && (status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable) {
+		retryAfter = defaultRetryAfter
+	}
+	if retryAfter > 0 {
+		header.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	}
+	header.Set("Content-Type", "application/json")
+	header.Set("X-Scrapoxy-Proxyerror", e.Code)
+	return header
+}
+
+// body returns the JSON body of the answer to the error.
+func (e *ProxyError) body(r *http.Request) []byte {
+	body, _ := json.Marshal(errorBody{
+		ID:      e.Code,
+		Message: e.Error(),
+		Method:  r.Method,
+		URL:     r.URL.String(),
+	})
+	return append(body, '\n')
+}
+
+// writeError answers the request with the JSON body of the error.
+func writeError(w http.ResponseWriter, r *http.Request, e *ProxyError) {
+	errorCounter.Inc()
+	for name, values := range e.header() {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(e.Status())
+	w.Write(e.body(r))
+}
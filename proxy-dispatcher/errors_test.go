@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWriteError(t *testing.T) {
+	initTestMetrics()
+	tests := []struct {
+		err               *ProxyError
+		status            int
+		proxyAuthenticate string
+		retryAfter        string
+	}{
+		{err: NewProxyError(ErrorNoToken, "No token", nil), status: http.StatusProxyAuthRequired, proxyAuthenticate: "Basic"},
+		{err: NewProxyError(ErrorBadToken, "Bad token", nil), status: http.StatusProxyAuthRequired, proxyAuthenticate: "Basic"},
+		{err: NewProxyError(ErrorNoProject, "No project", nil), status: http.StatusProxyAuthRequired, proxyAuthenticate: "Basic"},
+		{err: NewProxyError(ErrorNoProxy, "No proxy available", nil), status: http.StatusServiceUnavailable, retryAfter: "1"},
+		{err: NewProxyError(ErrorNoMatchingProxy, "No proxy available in country CA", nil), status: http.StatusServiceUnavailable, retryAfter: "1"},
+		{err: NewProxyError(ErrorProxyDialFailed, "Could not reach proxy", nil), status: http.StatusBadGateway},
+		{err: NewProxyError(ErrorProxyRefused, "Proxy refused", nil), status: http.StatusBadGateway},
+		{err: NewProxyError(ErrorUpstreamTimeout, "Proxy did not answer", nil), status: http.StatusGatewayTimeout},
+		{err: &ProxyError{Code: ErrorRateLimited, Message: "Rate limited", RetryAfter: 1500 * time.Millisecond}, status: http.StatusTooManyRequests, retryAfter: "2"},
+		{err: NewProxyError(ErrorTooManyTunnels, "Too many tunnels", nil), status: http.StatusTooManyRequests, retryAfter: "1"},
+		{err: NewProxyError(ErrorTargetDenied, "Target denied", nil), status: http.StatusForbidden},
+		{err: NewProxyError(ErrorTargetUnreachable, "Target unreachable", nil), status: http.StatusBadGateway},
+		{err: NewProxyError(ErrorUpstreamTLS, "TLS failed", nil), status: http.StatusBadGateway},
+		{err: NewProxyError("unknown", "Unknown", nil), status: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Code, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+			writeError(w, r, tt.err)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("X-Scrapoxy-Proxyerror"); got != tt.err.Code {
+				t.Errorf("X-Scrapoxy-Proxyerror = %q, want %q", got, tt.err.Code)
+			}
+			if got := w.Header().Get("Proxy-Authenticate"); got != tt.proxyAuthenticate {
+				t.Errorf("Proxy-Authenticate = %q, want %q", got, tt.proxyAuthenticate)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.retryAfter)
+			}
+			var body errorBody
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q is not JSON: %s", w.Body, err)
+			}
+			if body.ID != tt.err.Code || body.Message != tt.err.Message || body.Method != http.MethodConnect {
+				t.Errorf("body = %+v, want the code %s and the message %q", body, tt.err.Code, tt.err.Message)
+			}
+		})
+	}
+}
@@ -2,97 +2,110 @@ package main
 
 import (
 	"bufio"
-	"crypto/tls"
-	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
+	"proxy/utils"
+	"slices"
 	"strings"
-	"sync"
+	"time"
 )
 
+// HandlerConfig holds the settings of the dispatcher handler.
+type HandlerConfig struct {
+	// SessionTTL is how long a client session stays pinned to its proxy after its last use.
+	SessionTTL time.Duration
+	// ConnectRetries is how many other proxies are tried when a proxy cannot open a tunnel.
+	ConnectRetries int
+	// ConnectTimeout bounds the connection to a proxy and the wait for its CONNECT answer.
+	ConnectTimeout time.Duration
+	// IdleTimeout closes tunnels without traffic for that long, 0 to disable.
+	IdleTimeout time.Duration
+	// MaxTunnelDuration closes tunnels open for that long, 0 to disable.
+	MaxTunnelDuration time.Duration
+	// SocksHandshakeTimeout bounds the SOCKS5 greeting and request, 0 to disable.
+	SocksHandshakeTimeout time.Duration
+	// ForwardPlainHTTP sends plain HTTP requests to the proxy as they are, instead of
+	// opening a CONNECT tunnel to port 80 first.
+	ForwardPlainHTTP bool
+	TestMode         bool
+}
+
 type Handler struct {
 	repository Repository
-	testMode   bool
+	stats      *ProxyStats
+	health     *ProxyHealth
+	pool       *ProxyPool
+	sessions   SessionStore
+	limiter    *ProjectLimiter
+	labels     *MetricLabels
+	tracker    *utils.ConnTracker
+	mitm       *MITM
+	config     HandlerConfig
+	// middlewares handle the plain HTTP requests, the MITM has its own.
+	middlewares []Middleware
+}
+
+// NewHandler returns the dispatcher handler. mitm is nil when the dispatcher has no CA to
+// intercept the tunnels with.
+func NewHandler(repository Repository, stats *ProxyStats, health *ProxyHealth, pool *ProxyPool, sessions SessionStore, limiter *ProjectLimiter, labels *MetricLabels, tracker *utils.ConnTracker, mitm *MITM, config HandlerConfig) *Handler {
+	return &Handler{
+		repository: repository,
+		stats:      stats,
+		health:     health,
+		pool:       pool,
+		sessions:   sessions,
+		limiter:    limiter,
+		labels:     labels,
+		tracker:    tracker,
+		mitm:       mitm,
+		config:     config,
+	}
 }
 
-func NewHandler(repository Repository, testmode bool) *Handler {
-	return &Handler{repository, testmode}
+// Use appends a middleware to the chain of the plain HTTP requests. The requests go
+// through the middlewares in the order they were added, the responses in the reverse order.
+func (h *Handler) Use(middleware Middleware) {
+	h.middlewares = append(h.middlewares, middleware)
 }
 
 func (h Handler) handleRequest(w http.ResponseWriter, r *http.Request) {
 	requestCounter.Inc()
 	token := r.Header.Get("Proxy-Authorization")
-	tokenPart := strings.Split(token, " ")
-	if len(tokenPart) != 2 {
-		w.Header().Add("Proxy-Authenticate", `Basic`)
-		w.WriteHeader(407)
-		w.Write([]byte(fmt.Sprintf(`{"id": "%s", "message": "%s"}, "method": "%s", "url": "%s"`, "no_proxy", "No token found", r.Method, r.URL)))
-		errorCounter.Inc()
+	if token == "" {
+		writeError(w, r, NewProxyError(ErrorNoToken, "No token found", nil))
 		return
 	}
-	if tokenPart[0] != "Basic" && tokenPart[1] == "" {
-		w.Header().Add("Proxy-Authenticate", `Basic`)
-		w.WriteHeader(407)
-		w.Write([]byte(fmt.Sprintf(`{"id": "%s", "message": "%s"}, "method": "%s", "url": "%s"`, "no_proxy", "No token found", r.Method, r.URL)))
-		errorCounter.Inc()
-		return
-	}
-
-	project, err := h.repository.GetProjectByToken(tokenPart[1])
-	if err != nil {
-		log.Printf("Could not get project: %s\n", err)
-		w.WriteHeader(407)
-		w.Write([]byte(fmt.Sprintf(`{"id": "%s", "message": "%s"}, "method": "%s", "url": "%s"`, "no_project", err, r.Method, r.URL)))
-		errorCounter.Inc()
-		return
-	}
-
-	proxy, err := h.repository.GetProxyAndUpdateConnection(*project)
-	if err != nil {
-		log.Printf("Could not get proxy: %s\n", err)
-		w.WriteHeader(407)
-		w.Write([]byte(fmt.Sprintf(`{"id": "%s", "message": "%s"}, "method": "%s", "url": "%s"`, "no_proxy", err, r.Method, r.URL)))
-		errorCounter.Inc()
+	tokenPart := strings.Split(token, " ")
+	if len(tokenPart) != 2 || tokenPart[0] != "Basic" || tokenPart[1] == "" {
+		writeError(w, r, NewProxyError(ErrorBadToken, "Token is not a Basic authorization", nil))
 		return
 	}
 
-	// Open the TLS tunnel
-	//net.DialTimeout()
-	certPool := x509.NewCertPool()
-	if ok := certPool.AppendCertsFromPEM([]byte(proxy.Config.Certificate.Cert)); !ok {
-		errorCounter.Inc()
-		log.Fatalf("unable to parse proxy cert")
+	credentials := parseBasicCredentials(tokenPart[1])
+	if session := r.Header.Get("X-Scrapoxy-Session"); session != "" {
+		credentials.Session = session
 	}
-
-	cert, err := tls.X509KeyPair([]byte(proxy.Config.Certificate.Cert), []byte(proxy.Config.Certificate.Key))
-	if err != nil {
-		errorCounter.Inc()
-		log.Fatalf("unable to parse proxy cert and key: %s", err.Error())
+	if country := r.Header.Get("X-Scrapoxy-Country"); country != "" {
+		credentials.Geo.Country = country
 	}
-
-	config := &tls.Config{
-		Certificates:       []tls.Certificate{cert},
-		RootCAs:            certPool,
-		InsecureSkipVerify: true,
+	if continent := r.Header.Get("X-Scrapoxy-Continent"); continent != "" {
+		credentials.Geo.Continent = continent
 	}
-
-	//log.Printf("Connecting to %s:%d\n", proxy.Config.Address.Hostname, proxy.Config.Address.Port)
-	var proxyConn net.Conn
-	if h.testMode {
-		proxyConn, err = tls.Dial("tcp", fmt.Sprintf("%s:%d", "127.0.0.1", proxy.Config.Address.Port), config)
-	} else {
-		proxyConn, err = tls.Dial("tcp", fmt.Sprintf("%s:%d", proxy.Config.Address.Hostname, proxy.Config.Address.Port), config)
+	if asn := r.Header.Get("X-Scrapoxy-Asn"); asn != "" {
+		credentials.Geo.ASN = asn
 	}
 
+	project, err := h.repository.GetProjectByToken(credentials.Token)
 	if err != nil {
-		errorCounter.Inc()
-		log.Println(err)
+		log.Printf("Could not get project: %s\n", err)
+		writeError(w, r, NewProxyError(ErrorNoProject, "No project found for this token", err))
 		return
 	}
-	defer proxyConn.Close()
 
 	host := r.Host
 	if len(strings.Split(host, ":")) == 1 {
@@ -103,20 +116,35 @@ func (h Handler) handleRequest(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	//dataWritted, err := proxyConn.Write([]byte(fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)))
-	_, err = proxyConn.Write([]byte(fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)))
-	if err != nil {
-		log.Printf("Could not connect to proxy: %s\n", err.Error())
+	if perr := checkTarget(*project, host); perr != nil {
+		h.countTunnel(*project, nil, host, perr.Code)
+		writeError(w, r, perr)
+		return
 	}
 
-	scanner := bufio.NewScanner(proxyConn)
-	scanner.Scan()
-	line := scanner.Bytes()
-	if string(line) != "HTTP/1.1 200 OK" {
-		errorCounter.Inc()
-		log.Printf("Proxy return a non 200 HTTP response: %s\n", line)
-		w.WriteHeader(500)
-		w.Write([]byte(fmt.Sprintf(`{"id": "%s", "message": "%s"}`, "proxy_error", line)))
+	release, perr := h.limiter.Acquire(*project)
+	if perr != nil {
+		rejectedCounter.WithLabelValues(h.labels.Project(*project), perr.Code).Inc()
+		h.countTunnel(*project, nil, host, perr.Code)
+		writeError(w, r, perr)
+		return
+	}
+	defer release()
+
+	// The plain HTTP requests are forwarded one by one rather than tunneled: the next
+	// request of a keep-alive connection comes back here, to check its own target.
+	_, port, _ := net.SplitHostPort(host)
+	tunnel := r.Method == http.MethodConnect || r.URL.Scheme == "https" || port == "443"
+	proxy, proxyConn, perr := h.openTunnel(*project, credentials, host, tunnel || !h.config.ForwardPlainHTTP)
+	if perr != nil {
+		log.Printf("Could not open tunnel: %s\n", perr)
+		writeError(w, r, perr)
+		return
+	}
+	defer proxyConn.Close()
+
+	if !tunnel {
+		h.forwardRequest(w, r, *project, proxy, host, proxyConn)
 		return
 	}
 
@@ -127,57 +155,334 @@ func (h Handler) handleRequest(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "webserver doesn't support hijacking", http.StatusInternalServerError)
 		return
 	}
-	clientConn, _, err := hj.Hijack()
+	clientConn, bufrw, err := hj.Hijack()
+	if err != nil {
+		errorCounter.Inc()
+		log.Printf("Could not hijack connection: %s\n", err)
+		return
+	}
 	defer clientConn.Close()
+	defer h.tracker.Track(clientConn)()
+	if bufrw.Reader.Buffered() > 0 {
+		// The client may have sent data right after its request, like a TLS ClientHello.
+		clientConn = utils.NewBufferedConn(clientConn, bufrw.Reader)
+	}
 
-	if r.URL.Scheme == "https" || (len(strings.Split(host, ":")) == 2 && strings.Split(host, ":")[1] == "443") {
-		clientConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
-	} else {
-		r.RequestURI = ""
-		r.Header.Del("Accept-Encoding")
-		r.Header.Del("Proxy-Connection")
-		r.Header.Del("Proxy-Authenticate")
-		r.Header.Del("Proxy-Authorization")
-		if r.Header.Get("Connection") == "close" {
-			r.Close = false
-		}
-		r.Header.Del("Connection")
-		proxyReq, _ := http.NewRequest(r.Method, r.URL.String(), r.Body)
-		for name, values := range r.Header {
-			for _, value := range values {
-				proxyReq.Header.Add(name, value)
+	clientConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	if r.Method == http.MethodConnect && h.mitm.Enabled(*project) {
+		h.intercept(*project, proxy, host, clientConn, proxyConn)
+		return
+	}
+	h.pipe(*project, proxy, host, clientConn, proxyConn)
+}
+
+// forwardRequest sends a plain HTTP request through the middlewares to its target, over
+// the connection to the proxy, and writes the response back. The connection to the proxy
+// only serves this request.
+func (h Handler) forwardRequest(w http.ResponseWriter, r *http.Request, project Project, proxy *Proxy, host string, proxyConn net.Conn) {
+	h.stats.Acquire(proxy.ID)
+	defer h.stats.Release(proxy.ID)
+	start := time.Now()
+	upstreamConn := &countingConn{Conn: proxyConn}
+	var stats utils.RelayStats
+	defer func() {
+		stats.Sent, stats.Received = upstreamConn.written.Load(), upstreamConn.read.Load()
+		h.recordTunnel(project, proxy, host, start, stats)
+	}()
+
+	target := *r.URL
+	if target.Host == "" {
+		target.Scheme, target.Host = "http", r.Host
+	}
+	proxyReq := &http.Request{
+		Method:        r.Method,
+		URL:           &target,
+		Host:          r.Host,
+		Header:        r.Header.Clone(),
+		Body:          r.Body,
+		ContentLength: r.ContentLength,
+		Close:         true,
+	}
+	for _, name := range []string{"Accept-Encoding", "Connection", "Proxy-Connection", "Proxy-Authenticate", "Proxy-Authorization", "X-Scrapoxy-Session", "X-Scrapoxy-Country", "X-Scrapoxy-Continent", "X-Scrapoxy-Asn"} {
+		proxyReq.Header.Del(name)
+	}
+
+	exchange := &Exchange{Project: project, Proxy: proxy, Host: host, Request: proxyReq}
+	resp, perr := roundTrip(h.middlewares, exchange, upstreamConn, bufio.NewReader(upstreamConn), h.config.IdleTimeout, h.config.ForwardPlainHTTP)
+	if perr != nil {
+		log.Printf("Request to %s failed: %s\n", host, perr)
+		stats.ReceivedErr = perr
+		writeError(w, r, perr)
+		return
+	}
+	defer resp.Body.Close()
+	firstByteHistogram.Observe(time.Since(start).Seconds())
+
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	// The connection to the client is managed by the server.
+	for _, name := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding"} {
+		w.Header().Del(name)
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(flushWriter{w}, resp.Body); err != nil {
+		stats.ReceivedErr = err
+	}
+}
+
+// flushWriter sends each write to the client right away, for the streamed responses.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	http.NewResponseController(f.w).Flush()
+	return n, err
+}
+
+// openTunnel picks a proxy and asks it to CONNECT to host, or only connects to the proxy
+// when connect is false. When the proxy cannot be reached or refuses the tunnel, other
+// proxies are tried until the retry budget is spent. The failures on the side of the
+// target are returned right away.
+func (h Handler) openTunnel(project Project, credentials Credentials, host string, connect bool) (*Proxy, net.Conn, *ProxyError) {
+	var failed []string
+	for attempt := 0; ; attempt++ {
+		domain := targetDomain(host)
+		proxy, err := h.selectProxy(project, credentials, domain, failed)
+		if err != nil {
+			perr := NewProxyError(ErrorNoProxy, "Could not get proxy", err)
+			if errors.Is(err, ErrNoMatchingProxy) {
+				perr = NewProxyError(ErrorNoMatchingProxy, "No proxy available in "+credentials.Geo.String(), nil)
+			} else if errors.Is(err, ErrNoProxy) {
+				perr = NewProxyError(ErrorNoProxy, "No proxy available", nil)
 			}
+			h.countTunnel(project, nil, host, perr.Code)
+			return nil, nil, perr
 		}
-		err = proxyReq.Write(proxyConn)
-		if err != nil {
-			log.Println(err.Error())
+		h.stats.RecordUse(proxy.ID, domain)
+
+		proxyConn, perr := h.tunnelThrough(proxy, host, connect)
+		if perr == nil {
+			h.health.RecordSuccess(proxy.ID)
+			h.countTunnel(project, proxy, host, "ok")
+			return proxy, proxyConn, nil
+		}
+		h.countTunnel(project, proxy, host, perr.Code)
+		if !proxyFailed(perr) {
+			// The proxy works, another one would fail on the target as well.
+			return nil, nil, perr
 		}
+		if h.health.RecordFailure(proxy.ID) {
+			log.Printf("Proxy %s is quarantined after too many failures\n", proxy.ID)
+		}
+
+		if attempt >= h.config.ConnectRetries {
+			return nil, nil, perr
+		}
+		log.Printf("Could not open tunnel through proxy %s, retrying: %s\n", proxy.ID, perr)
+		retryCounter.WithLabelValues(perr.Code).Inc()
+		failed = append(failed, proxy.ID)
+	}
+}
+
+// selectProxy returns the proxy the client session is pinned to. When there is no
+// session yet, or its proxy is not available anymore, it picks a new proxy and pins the
+// session to it. Proxies listed in exclude, or excluded for the domain, are never returned.
+func (h Handler) selectProxy(project Project, credentials Credentials, domain string, exclude []string) (*Proxy, error) {
+	query := ProxyQuery{Exclude: exclude, Domain: domain, Geo: credentials.Geo}
+	if credentials.Session == "" || h.sessions == nil {
+		return h.repository.GetProxyAndUpdateConnection(project, query)
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(1)
+	key := project.ID + ":" + credentials.Session
+	if proxyID, ok := h.sessions.Get(key); ok && !slices.Contains(exclude, proxyID) {
+		proxy, err := h.repository.GetProxyAndUpdateConnection(project, ProxyQuery{ProxyID: proxyID, Domain: domain, Geo: credentials.Geo})
+		if err == nil {
+			h.sessions.Set(key, proxy.ID, h.config.SessionTTL)
+			return proxy, nil
+		}
+		if !errors.Is(err, ErrNoProxy) {
+			return nil, err
+		}
+		log.Printf("Proxy %s of session %s is not available anymore\n", proxyID, credentials.Session)
+		// The session is not left pinned to the proxy when no other one can take it.
+		h.sessions.Delete(key)
+	}
 
-	// client<-proxyconn
-	go func() {
-		i, err := io.Copy(clientConn, proxyConn)
-		bytesReceivedCounter.Add(float64(i))
+	proxy, err := h.repository.GetProxyAndUpdateConnection(project, query)
+	if err != nil {
+		return nil, err
+	}
+	h.sessions.Set(key, proxy.ID, h.config.SessionTTL)
+	return proxy, nil
+}
+
+// proxyAddress returns the address the dispatcher connects to for the proxy.
+func (h Handler) proxyAddress(proxy *Proxy) string {
+	//log.Printf("Connecting to %s:%d\n", proxy.Config.Address.Hostname, proxy.Config.Address.Port)
+	if h.config.TestMode {
+		return fmt.Sprintf("%s:%d", "127.0.0.1", proxy.Config.Address.Port)
+	}
+	return fmt.Sprintf("%s:%d", proxy.Config.Address.Hostname, proxy.Config.Address.Port)
+}
+
+// tunnelThrough opens a tunnel to host through the proxy, reusing an idle connection to
+// the proxy when the pool has one.
+func (h Handler) tunnelThrough(proxy *Proxy, host string, connect bool) (net.Conn, *ProxyError) {
+	address := h.proxyAddress(proxy)
+	if !connect {
+		// Without the CONNECT answer, a stale idle connection could not be told apart from
+		// a failing request, so a new connection is opened.
+		proxyConn, err := h.pool.Dial(proxy, address)
 		if err != nil {
-			return
+			return nil, NewProxyError(ErrorProxyDialFailed, "Could not reach proxy", err)
 		}
-	}()
+		return proxyConn, nil
+	}
+
+	proxyConn, reused, err := h.pool.Get(proxy, address)
+	if err != nil {
+		return nil, NewProxyError(ErrorProxyDialFailed, "Could not reach proxy", err)
+	}
 
-	// proxyconn<-client
-	go func() {
-		defer wg.Done()
-		i, err := io.Copy(proxyConn, clientConn)
-		bytesSentCounter.Add(float64(i))
+	conn, perr := h.connectProxy(proxyConn, host)
+	if perr != nil && reused && perr.Err != nil && perr.Code != ErrorUpstreamTimeout {
+		// The proxy may have closed the idle connection in the meantime.
+		proxyConn, err = h.pool.Dial(proxy, address)
 		if err != nil {
-			fmt.Println(err.Error())
-			return
+			return nil, NewProxyError(ErrorProxyDialFailed, "Could not reach proxy", err)
 		}
-	}()
+		conn, perr = h.connectProxy(proxyConn, host)
+	}
+	return conn, perr
+}
 
-	wg.Wait()
-	clientConn.Close()
-	return
+// connectProxy asks the proxy to open a tunnel to host and checks that it accepted. The
+// returned connection must be used for the tunnel in place of proxyConn, which is closed
+// on failure.
+func (h Handler) connectProxy(proxyConn net.Conn, host string) (net.Conn, *ProxyError) {
+	start := time.Now()
+	proxyConn.SetDeadline(time.Now().Add(h.config.ConnectTimeout))
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: host},
+		Host:   host,
+		Header: make(http.Header),
+	}
+	if err := req.Write(proxyConn); err != nil {
+		proxyConn.Close()
+		return nil, NewProxyError(ErrorProxyDialFailed, "Could not send CONNECT to proxy", err)
+	}
+
+	reader := bufio.NewReader(proxyConn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		proxyConn.Close()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, NewProxyError(ErrorUpstreamTimeout, "Proxy did not answer CONNECT in time", err)
+		}
+		return nil, NewProxyError(ErrorProxyRefused, "Could not read CONNECT response from proxy", err)
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		proxyConn.Close()
+		return nil, NewProxyError(ErrorTargetDenied, "Target denied by proxy: "+resp.Header.Get("X-Scrapoxy-Proxyerror"), nil)
+	}
+	if resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusInternalServerError {
+		// The proxy could not reach the target. The proxies answering 500 predate the 502.
+		proxyConn.Close()
+		return nil, NewProxyError(ErrorTargetUnreachable, "Target unreachable from proxy: "+resp.Header.Get("X-Scrapoxy-Proxyerror"), nil)
+	}
+	if resp.StatusCode != http.StatusOK {
+		proxyConn.Close()
+		return nil, NewProxyError(ErrorProxyRefused, fmt.Sprintf("Proxy answered %s: %s", resp.Status, resp.Header.Get("X-Scrapoxy-Proxyerror")), nil)
+	}
+	proxyConn.SetDeadline(time.Time{})
+	proxyConnectHistogram.Observe(time.Since(start).Seconds())
+	return utils.NewBufferedConn(proxyConn, reader), nil
+}
+
+// proxyFailed tells whether the error comes from the proxy itself, so that it counts
+// against its health and another proxy is tried. A CONNECT answer that does not come in
+// time may be the proxy waiting on a target that does not answer, so it does not count.
+func proxyFailed(perr *ProxyError) bool {
+	switch perr.Code {
+	case ErrorProxyDialFailed, ErrorProxyRefused:
+		return true
+	}
+	return false
+}
+
+// checkTarget applies the target policy of the project to host, before any proxy is
+// involved.
+func checkTarget(project Project, host string) *ProxyError {
+	if project.TargetPolicy == nil {
+		return nil
+	}
+	policy, err := project.TargetPolicy.Policy()
+	if err != nil {
+		return NewProxyError(ErrorTargetDenied, "Invalid target policy", err)
+	}
+	var policyErr *utils.PolicyError
+	if err = policy.CheckHost(host); errors.As(err, &policyErr) {
+		return NewProxyError(ErrorTargetDenied, "Target denied: "+policyErr.Reason, nil)
+	} else if err != nil {
+		// A target the policy could not check is not let through.
+		return NewProxyError(ErrorTargetDenied, "Target could not be checked", err)
+	}
+	return nil
+}
+
+// countTunnel counts a tunnel attempt by project, proxy, host class and outcome, which is
+// "ok" or the code of the error.
+func (h Handler) countTunnel(project Project, proxy *Proxy, host, outcome string) {
+	tunnelCounter.WithLabelValues(append(h.labels.Tunnel(project, proxy, host), outcome)...).Inc()
+}
+
+// pipe relays data between the client and the proxy until both are done.
+func (h Handler) pipe(project Project, proxy *Proxy, host string, clientConn, proxyConn net.Conn) {
+	h.stats.Acquire(proxy.ID)
+	defer h.stats.Release(proxy.ID)
+
+	start := time.Now()
+	stats := utils.Relay(clientConn, proxyConn, h.relayOptions(start))
+	h.recordTunnel(project, proxy, host, start, stats)
+}
+
+// intercept serves the tunnel through the MITM until both sides are done.
+func (h Handler) intercept(project Project, proxy *Proxy, host string, clientConn, proxyConn net.Conn) {
+	h.stats.Acquire(proxy.ID)
+	defer h.stats.Release(proxy.ID)
+
+	start := time.Now()
+	exchange := Exchange{Project: project, Proxy: proxy, Host: host}
+	stats := h.mitm.Serve(exchange, clientConn, proxyConn, h.relayOptions(start))
+	h.recordTunnel(project, proxy, host, start, stats)
+}
+
+func (h Handler) relayOptions(start time.Time) utils.RelayOptions {
+	return utils.RelayOptions{
+		IdleTimeout: h.config.IdleTimeout,
+		MaxDuration: h.config.MaxTunnelDuration,
+		OnFirstReceived: func() {
+			firstByteHistogram.Observe(time.Since(start).Seconds())
+		},
+	}
+}
+
+// recordTunnel records the metrics of a tunnel once it is closed.
+func (h Handler) recordTunnel(project Project, proxy *Proxy, host string, start time.Time, stats utils.RelayStats) {
+	tunnelDurationHistogram.Observe(time.Since(start).Seconds())
+
+	labels := h.labels.Tunnel(project, proxy, host)
+	bytesReceivedCounter.Add(float64(stats.Received))
+	bytesSentCounter.Add(float64(stats.Sent))
+	tunnelBytesReceivedCounter.WithLabelValues(labels...).Add(float64(stats.Received))
+	tunnelBytesSentCounter.WithLabelValues(labels...).Add(float64(stats.Sent))
+	// The project and host class are enough here, a series per proxy would multiply the buckets.
+	tunnelSizeHistogram.WithLabelValues(labels[0], labels[2]).Observe(float64(stats.Received))
+	if err := stats.Err(); err != nil {
+		log.Printf("Tunnel through proxy %s closed: %s\n", proxy.ID, err)
+	}
 }
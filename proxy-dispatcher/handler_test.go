@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"proxy/utils"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+var initMetricsOnce sync.Once
+
+// initTestMetrics creates the metrics main creates, unregistered, so that the handler can
+// update them.
+func initTestMetrics() {
+	initMetricsOnce.Do(func() {
+		requestCounter = prometheus.NewCounter(prometheus.CounterOpts{Name: "requests_count"})
+		errorCounter = prometheus.NewCounter(prometheus.CounterOpts{Name: "errors_count"})
+		bytesReceivedCounter = prometheus.NewCounter(prometheus.CounterOpts{Name: "bytes_received"})
+		bytesSentCounter = prometheus.NewCounter(prometheus.CounterOpts{Name: "bytes_sent"})
+		retryCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "connect_retries"}, []string{"code"})
+		rejectedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "rejected_count"}, []string{"project", "code"})
+		tunnelCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "tunnels_count"}, []string{"project", "proxy", "host_class", "outcome"})
+		tunnelBytesReceivedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "tunnel_bytes_received"}, []string{"project", "proxy", "host_class"})
+		tunnelBytesSentCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "tunnel_bytes_sent"}, []string{"project", "proxy", "host_class"})
+		tunnelSizeHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "tunnel_size_bytes"}, []string{"project", "host_class"})
+		proxyDialHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "proxy_dial_seconds"})
+		proxyConnectHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "proxy_connect_seconds"})
+		firstByteHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "first_byte_seconds"})
+		tunnelDurationHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "tunnel_duration_seconds"})
+		bansDetectedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "bans_detected"}, []string{"domain"})
+	})
+}
+
+// testRepository serves a single project and picks its proxies in order. The project is
+// only found with token, when set.
+type testRepository struct {
+	mutex   sync.Mutex
+	token   string
+	project Project
+	proxies []Proxy
+	queries []ProxyQuery
+}
+
+func (r *testRepository) GetProjectByToken(token string) (*Project, error) {
+	if r.token != "" && token != r.token {
+		return nil, errors.New("project not found")
+	}
+	project := r.project
+	return &project, nil
+}
+
+func (r *testRepository) GetProxyAndUpdateConnection(project Project, query ProxyQuery) (*Proxy, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.queries = append(r.queries, query)
+	for _, proxy := range r.proxies {
+		if !slices.Contains(query.Exclude, proxy.ID) && (query.ProxyID == "" || proxy.ID == query.ProxyID) {
+			return &proxy, nil
+		}
+	}
+	return nil, ErrNoProxy
+}
+
+func (r *testRepository) GetProjectCount() int64              { return 1 }
+func (r *testRepository) GetConnectorCount() int64            { return 0 }
+func (r *testRepository) GetProxyCount() int64                { return int64(len(r.proxies)) }
+func (r *testRepository) GetProxyCountByStatus() ProxyMetrics { return ProxyMetrics{} }
+
+// newTestProxy starts a TLS server standing for a Scrapoxy proxy. serve answers each
+// request the server reads, it returns whether the connection can serve another one.
+func newTestProxy(t *testing.T, id string, serve func(conn net.Conn, reader *bufio.Reader, req *http.Request) bool) Proxy {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: id},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					req, err := http.ReadRequest(reader)
+					if err != nil || !serve(conn, reader, req) {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	proxy := Proxy{ID: id}
+	proxy.Config.Address.Hostname = "127.0.0.1"
+	proxy.Config.Address.Port = l.Addr().(*net.TCPAddr).Port
+	proxy.Config.Certificate.Cert = string(certPEM)
+	proxy.Config.Certificate.Key = string(keyPEM)
+	return proxy
+}
+
+// answer returns a serve function of newTestProxy writing the same response to every
+// request.
+func answer(response string) func(net.Conn, *bufio.Reader, *http.Request) bool {
+	return func(conn net.Conn, _ *bufio.Reader, _ *http.Request) bool {
+		conn.Write([]byte(response))
+		return false
+	}
+}
+
+func newTestHandler(repository Repository, config HandlerConfig) *Handler {
+	initTestMetrics()
+	if config.ConnectTimeout == 0 {
+		config.ConnectTimeout = 5 * time.Second
+	}
+	stats := NewProxyStats()
+	health := NewProxyHealth(1, time.Minute, time.Minute)
+	pool := NewProxyPool(0, time.Minute, 5*time.Second, stats)
+	labels := NewMetricLabels(NewLabelLimiter(nil, 10), NewLabelLimiter(nil, 10))
+	return NewHandler(repository, stats, health, pool, NewMemorySessionStore(), NewProjectLimiter(), labels, utils.NewConnTracker(), nil, config)
+}
+
+func TestHandler_openTunnel(t *testing.T) {
+	refused := "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"
+	unreachable := "HTTP/1.1 502 target_unreachable\r\nX-Scrapoxy-Proxyerror: connection refused\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"
+	established := "HTTP/1.1 200 OK\r\n\r\n"
+
+	tests := []struct {
+		name        string
+		answers     []string
+		wantCode    string
+		wantProxies int
+		wantFailed  []string
+	}{
+		{name: "established", answers: []string{established}, wantProxies: 1},
+		{name: "refused then established", answers: []string{refused, established}, wantProxies: 2, wantFailed: []string{"p0"}},
+		{name: "target unreachable", answers: []string{unreachable, established}, wantCode: ErrorTargetUnreachable, wantProxies: 1},
+		{name: "target denied", answers: []string{"HTTP/1.1 403 target_denied\r\n\r\n", established}, wantCode: ErrorTargetDenied, wantProxies: 1},
+		{name: "all refused", answers: []string{refused, refused, refused}, wantCode: ErrorProxyRefused, wantProxies: 2, wantFailed: []string{"p0", "p1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repository := &testRepository{project: Project{ID: "project"}}
+			for i, response := range tt.answers {
+				repository.proxies = append(repository.proxies, newTestProxy(t, fmt.Sprintf("p%d", i), answer(response)))
+			}
+			h := newTestHandler(repository, HandlerConfig{ConnectRetries: 1})
+
+			_, conn, perr := h.openTunnel(repository.project, Credentials{}, "example.com:443", true)
+			if conn != nil {
+				conn.Close()
+			}
+			if (perr == nil && tt.wantCode != "") || (perr != nil && perr.Code != tt.wantCode) {
+				t.Fatalf("openTunnel() = %v, want code %q", perr, tt.wantCode)
+			}
+			if len(repository.queries) != tt.wantProxies {
+				t.Errorf("proxies tried = %d, want %d", len(repository.queries), tt.wantProxies)
+			}
+			var failed []string
+			for id := range h.health.proxies {
+				failed = append(failed, id)
+			}
+			slices.Sort(failed)
+			if !slices.Equal(failed, tt.wantFailed) {
+				t.Errorf("proxies with failures = %v, want %v", failed, tt.wantFailed)
+			}
+		})
+	}
+}
+
+// echo is a serve function of newTestProxy that opens the tunnels and answers the
+// requests with their target and User-Agent.
+func echo(conn net.Conn, _ *bufio.Reader, req *http.Request) bool {
+	if req.Method == http.MethodConnect {
+		conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+		return true
+	}
+	body := req.Host + req.URL.Path
+	fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nX-User-Agent: %s\r\nContent-Length: %d\r\n\r\n%s", req.UserAgent(), len(body), body)
+	return !req.Close
+}
+
+// sendRequests writes the requests on a single connection to the dispatcher and returns
+// the responses.
+func sendRequests(t *testing.T, h *Handler, requests ...string) []*http.Response {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(h.handleRequest))
+	t.Cleanup(server.Close)
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	var responses []*http.Response
+	for _, request := range requests {
+		if _, err = conn.Write([]byte(request)); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		responses = append(responses, resp)
+	}
+	return responses
+}
+
+func TestHandler_handleRequest_plainHTTP(t *testing.T) {
+	for _, forward := range []bool{false, true} {
+		t.Run(fmt.Sprintf("forward %v", forward), func(t *testing.T) {
+			repository := &testRepository{
+				project: Project{ID: "project", TargetPolicy: &TargetPolicy{DenyHosts: []string{"denied.example"}}},
+				proxies: []Proxy{newTestProxy(t, "p", echo)},
+			}
+			h := newTestHandler(repository, HandlerConfig{ForwardPlainHTTP: forward})
+
+			auth := "Proxy-Authorization: Basic dG9rZW4=\r\n"
+			responses := sendRequests(t, h,
+				"GET http://allowed.example/a HTTP/1.1\r\nHost: allowed.example\r\n"+auth+"\r\n",
+				"GET http://denied.example/b HTTP/1.1\r\nHost: denied.example\r\n"+auth+"\r\n",
+				"GET http://allowed.example/c HTTP/1.1\r\nHost: allowed.example\r\n"+auth+"\r\n",
+			)
+
+			wants := []struct {
+				status int
+				body   string
+			}{
+				{status: http.StatusOK, body: "allowed.example/a"},
+				{status: http.StatusForbidden},
+				{status: http.StatusOK, body: "allowed.example/c"},
+			}
+			for i, want := range wants {
+				body, _ := io.ReadAll(responses[i].Body)
+				if responses[i].StatusCode != want.status || (want.body != "" && string(body) != want.body) {
+					t.Errorf("request #%d = %d %q, want %d %q", i, responses[i].StatusCode, body, want.status, want.body)
+				}
+			}
+		})
+	}
+}
+
+func TestHandler_handleRequest_userAgent(t *testing.T) {
+	tests := []struct {
+		policy  string
+		forward bool
+		want    []string
+	}{
+		{policy: UserAgentFill, want: []string{"client-agent", "proxy-agent"}},
+		{policy: UserAgentFill, forward: true, want: []string{"client-agent", "proxy-agent"}},
+		{policy: UserAgentOverwrite, want: []string{"proxy-agent", "proxy-agent"}},
+		{policy: UserAgentKeep, want: []string{"client-agent", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s forward %v", tt.policy, tt.forward), func(t *testing.T) {
+			proxy := newTestProxy(t, "p", echo)
+			proxy.UserAgent = "proxy-agent"
+			repository := &testRepository{
+				project: Project{ID: "project", UserAgentPolicy: tt.policy},
+				proxies: []Proxy{proxy},
+			}
+			h := newTestHandler(repository, HandlerConfig{ForwardPlainHTTP: tt.forward})
+			h.Use(UserAgentMiddleware{})
+
+			auth := "Proxy-Authorization: Basic dG9rZW4=\r\n"
+			responses := sendRequests(t, h,
+				"GET http://example.com/a HTTP/1.1\r\nHost: example.com\r\nUser-Agent: client-agent\r\n"+auth+"\r\n",
+				"GET http://example.com/b HTTP/1.1\r\nHost: example.com\r\n"+auth+"\r\n",
+			)
+
+			for i, want := range tt.want {
+				if got := responses[i].Header.Get("X-User-Agent"); got != want {
+					t.Errorf("request #%d User-Agent = %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHandler_handleRequest_ban(t *testing.T) {
+	banned := func(conn net.Conn, reader *bufio.Reader, req *http.Request) bool {
+		if req.Method == http.MethodConnect {
+			return echo(conn, reader, req)
+		}
+		conn.Write([]byte("HTTP/1.1 429 Too Many Requests\r\nContent-Length: 0\r\n\r\n"))
+		return !req.Close
+	}
+	for _, forward := range []bool{false, true} {
+		t.Run(fmt.Sprintf("forward %v", forward), func(t *testing.T) {
+			repository := &testRepository{
+				project: Project{ID: "project", BanRules: &BanRules{StatusCodes: []int{http.StatusTooManyRequests}}},
+				proxies: []Proxy{newTestProxy(t, "p0", banned)},
+			}
+			h := newTestHandler(repository, HandlerConfig{ForwardPlainHTTP: forward})
+			cooldowns := NewDomainCooldowns()
+			h.Use(NewBanMiddleware(cooldowns, NewLabelLimiter(nil, 10), time.Minute))
+
+			auth := "Proxy-Authorization: Basic dG9rZW4=\r\n"
+			responses := sendRequests(t, h, "GET http://www.example.com/ HTTP/1.1\r\nHost: www.example.com\r\n"+auth+"\r\n")
+			if responses[0].StatusCode != http.StatusTooManyRequests {
+				t.Errorf("handleRequest() = %d, want %d", responses[0].StatusCode, http.StatusTooManyRequests)
+			}
+			excluded := cooldowns.Excluded(repository.project, ProxyQuery{Domain: "www.example.com"})
+			if !slices.Equal(excluded, []string{"p0"}) {
+				t.Errorf("Excluded() = %v, want [p0]", excluded)
+			}
+		})
+	}
+}
+
+func TestCheckTarget(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *TargetPolicy
+		host   string
+		denied bool
+	}{
+		{name: "no policy", host: "example.com:443"},
+		{name: "allowed", policy: &TargetPolicy{DenyHosts: []string{"denied.example"}}, host: "example.com:443"},
+		{name: "denied", policy: &TargetPolicy{DenyHosts: []string{"denied.example"}}, host: "denied.example:443", denied: true},
+		{name: "invalid policy", policy: &TargetPolicy{DenyCIDRs: []string{"not a cidr"}}, host: "example.com:443", denied: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			perr := checkTarget(Project{TargetPolicy: tt.policy}, tt.host)
+			if (perr != nil) != tt.denied || (perr != nil && perr.Code != ErrorTargetDenied) {
+				t.Errorf("checkTarget() = %v, want denied %v", perr, tt.denied)
+			}
+		})
+	}
+
+	// The copies of a loaded project share the policy built for it.
+	project := Project{TargetPolicy: &TargetPolicy{DenyHosts: []string{"denied.example"}}}
+	first, _ := project.TargetPolicy.Policy()
+	copied := project
+	if second, _ := copied.TargetPolicy.Policy(); first == nil || second != first {
+		t.Errorf("Policy() = %p, want the policy built first %p", second, first)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type proxyHealth struct {
+	failures    int
+	quarantines int
+	until       time.Time
+	lastFailure time.Time
+}
+
+// ProxyHealth counts the consecutive failures of each proxy and quarantines the proxies
+// that fail too often. The quarantine doubles each time the proxy fails again right after
+// it is released, up to maxBackoff.
+type ProxyHealth struct {
+	mutex      sync.Mutex
+	threshold  int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	proxies    map[string]*proxyHealth
+}
+
+func NewProxyHealth(threshold int, backoff, maxBackoff time.Duration) *ProxyHealth {
+	h := &ProxyHealth{
+		threshold:  threshold,
+		backoff:    backoff,
+		maxBackoff: maxBackoff,
+		proxies:    make(map[string]*proxyHealth),
+	}
+	go h.purge(time.Minute)
+	return h
+}
+
+// RecordSuccess forgets the failures of the proxy.
+func (h *ProxyHealth) RecordSuccess(proxyID string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.proxies, proxyID)
+}
+
+// RecordFailure counts a failure of the proxy and reports whether it is now quarantined.
+func (h *ProxyHealth) RecordFailure(proxyID string) bool {
+	if h.threshold <= 0 {
+		return false
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	p, ok := h.proxies[proxyID]
+	if !ok {
+		p = &proxyHealth{}
+		h.proxies[proxyID] = p
+	}
+	p.failures++
+	p.lastFailure = time.Now()
+	if p.failures < h.threshold {
+		return false
+	}
+
+	backoff := h.backoff << p.quarantines
+	if backoff > h.maxBackoff || backoff <= 0 {
+		backoff = h.maxBackoff
+	}
+	p.until = time.Now().Add(backoff)
+	p.quarantines++
+	// A single failure after the quarantine puts the proxy back in quarantine.
+	p.failures = h.threshold - 1
+	return true
+}
+
+// Quarantined returns the proxies currently in quarantine.
+func (h *ProxyHealth) Quarantined() []string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	now := time.Now()
+	var ids []string
+	for id, p := range h.proxies {
+		if now.Before(p.until) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Excluded implements ProxyFilter so quarantined proxies are never selected.
+func (h *ProxyHealth) Excluded(project Project, query ProxyQuery) []string {
+	return h.Quarantined()
+}
+
+// purge forgets the proxies out of quarantine that have not failed for maxBackoff every
+// interval, like the proxies removed from Scrapoxy.
+func (h *ProxyHealth) purge(interval time.Duration) {
+	for range time.Tick(interval) {
+		h.prune(time.Now())
+	}
+}
+
+func (h *ProxyHealth) prune(now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for id, p := range h.proxies {
+		if now.After(p.until) && now.Sub(p.lastFailure) > h.maxBackoff {
+			delete(h.proxies, id)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProxyHealth_RecordFailure(t *testing.T) {
+	health := NewProxyHealth(2, time.Minute, 10*time.Minute)
+
+	if health.RecordFailure("p") {
+		t.Fatalf("RecordFailure() #1 = true, want false")
+	}
+	if !health.RecordFailure("p") {
+		t.Fatalf("RecordFailure() #2 = false, want true")
+	}
+	if got := health.Quarantined(); len(got) != 1 || got[0] != "p" {
+		t.Fatalf("Quarantined() = %v, want [p]", got)
+	}
+	health.RecordSuccess("p")
+	if got := health.Quarantined(); len(got) != 0 {
+		t.Fatalf("Quarantined() after success = %v, want none", got)
+	}
+}
+
+func TestProxyHealth_prune(t *testing.T) {
+	health := NewProxyHealth(1, time.Minute, 10*time.Minute)
+	health.RecordFailure("p")
+	now := time.Now()
+
+	health.prune(now.Add(5 * time.Minute))
+	if _, ok := health.proxies["p"]; !ok {
+		t.Fatalf("prune() forgot a proxy that failed recently")
+	}
+	health.prune(now.Add(11 * time.Minute))
+	if _, ok := health.proxies["p"]; ok {
+		t.Fatalf("prune() kept a proxy that has not failed for maxBackoff")
+	}
+}
+
+func Test_proxyFailed(t *testing.T) {
+	tests := map[string]bool{
+		ErrorProxyDialFailed:   true,
+		ErrorProxyRefused:      true,
+		ErrorTargetUnreachable: false,
+		ErrorUpstreamTimeout:   false,
+		ErrorTargetDenied:      false,
+	}
+	for code, want := range tests {
+		if got := proxyFailed(NewProxyError(code, "", nil)); got != want {
+			t.Errorf("proxyFailed(%s) = %v, want %v", code, got, want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// rate and burst are the project settings of the last take.
+	rate  float64
+	burst float64
+}
+
+// full tells whether the bucket refilled up to its burst at now, it is then the same as a
+// new bucket.
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// ProjectLimiter enforces the request rate and the number of concurrent tunnels each
+// project allows, as configured on the project document.
+type ProjectLimiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	tunnels map[string]int
+}
+
+func NewProjectLimiter() *ProjectLimiter {
+	l := &ProjectLimiter{
+		buckets: make(map[string]*tokenBucket),
+		tunnels: make(map[string]int),
+	}
+	go l.purge(time.Minute)
+	return l
+}
+
+// Acquire admits a new tunnel for the project. The returned function must be called once
+// the tunnel is closed. When the project is over one of its limits, the error tells the
+// client how long to wait before retrying.
+func (l *ProjectLimiter) Acquire(project Project) (func(), *ProxyError) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if project.MaxConcurrentTunnels > 0 && l.tunnels[project.ID] >= project.MaxConcurrentTunnels {
+		perr := NewProxyError(ErrorTooManyTunnels, "Too many concurrent tunnels for this project", nil)
+		perr.RetryAfter = time.Second
+		return nil, perr
+	}
+
+	if project.RateLimit > 0 {
+		if wait := l.take(project, time.Now()); wait > 0 {
+			perr := NewProxyError(ErrorRateLimited, "Rate limit exceeded for this project", nil)
+			perr.RetryAfter = wait
+			return nil, perr
+		}
+	}
+
+	l.tunnels[project.ID]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mutex.Lock()
+			defer l.mutex.Unlock()
+			l.tunnels[project.ID]--
+			if l.tunnels[project.ID] <= 0 {
+				delete(l.tunnels, project.ID)
+			}
+		})
+	}, nil
+}
+
+// take removes a token from the bucket of the project, or returns how long until one is
+// available. The bucket holds up to RateBurst tokens, at least one, and refills at
+// RateLimit tokens per second. The caller must hold the mutex.
+func (l *ProjectLimiter) take(project Project, now time.Time) time.Duration {
+	burst := math.Max(float64(project.RateBurst), 1)
+	bucket, ok := l.buckets[project.ID]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, last: now}
+		l.buckets[project.ID] = bucket
+	}
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*project.RateLimit)
+	bucket.last = now
+	bucket.rate = project.RateLimit
+	bucket.burst = burst
+
+	if bucket.tokens < 1 {
+		return time.Duration((1 - bucket.tokens) / project.RateLimit * float64(time.Second))
+	}
+	bucket.tokens--
+	return 0
+}
+
+// purge forgets the buckets that are full again every interval, like the ones of the
+// projects deleted from Scrapoxy.
+func (l *ProjectLimiter) purge(interval time.Duration) {
+	for range time.Tick(interval) {
+		l.prune(time.Now())
+	}
+}
+
+func (l *ProjectLimiter) prune(now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for id, bucket := range l.buckets {
+		if bucket.full(now) {
+			delete(l.buckets, id)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProjectLimiter_Acquire(t *testing.T) {
+	limiter := NewProjectLimiter()
+	project := Project{ID: "p", MaxConcurrentTunnels: 2}
+
+	first, perr := limiter.Acquire(project)
+	if perr != nil {
+		t.Fatalf("Acquire() = %v, want nil", perr)
+	}
+	if _, perr = limiter.Acquire(project); perr != nil {
+		t.Fatalf("Acquire() = %v, want nil", perr)
+	}
+	if _, perr = limiter.Acquire(project); perr == nil || perr.Code != ErrorTooManyTunnels {
+		t.Fatalf("Acquire() = %v, want %s", perr, ErrorTooManyTunnels)
+	}
+	first()
+	first()
+	if _, perr = limiter.Acquire(project); perr != nil {
+		t.Fatalf("Acquire() after release = %v, want nil", perr)
+	}
+}
+
+func TestProjectLimiter_take(t *testing.T) {
+	limiter := NewProjectLimiter()
+	project := Project{ID: "p", RateLimit: 2, RateBurst: 2}
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if wait := limiter.take(project, now); wait != 0 {
+			t.Fatalf("take() #%d = %s, want 0", i, wait)
+		}
+	}
+	if wait := limiter.take(project, now); wait != 500*time.Millisecond {
+		t.Fatalf("take() = %s, want 500ms", wait)
+	}
+	if wait := limiter.take(project, now.Add(500*time.Millisecond)); wait != 0 {
+		t.Fatalf("take() after refill = %s, want 0", wait)
+	}
+}
+
+func TestProjectLimiter_prune(t *testing.T) {
+	limiter := NewProjectLimiter()
+	project := Project{ID: "p", RateLimit: 1, RateBurst: 2}
+	now := time.Now()
+	limiter.take(project, now)
+	limiter.take(project, now)
+
+	limiter.prune(now.Add(time.Second))
+	if _, ok := limiter.buckets["p"]; !ok {
+		t.Fatalf("prune() forgot a bucket still refilling")
+	}
+	limiter.prune(now.Add(2 * time.Second))
+	if _, ok := limiter.buckets["p"]; ok {
+		t.Fatalf("prune() kept a full bucket")
+	}
+}
@@ -8,8 +8,13 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"proxy/collector"
+	"proxy/utils"
+	"syscall"
 	"time"
 )
 
@@ -18,6 +23,20 @@ var (
 	errorCounter         prometheus.Counter
 	bytesReceivedCounter prometheus.Counter
 	bytesSentCounter     prometheus.Counter
+	retryCounter         *prometheus.CounterVec
+	rejectedCounter      *prometheus.CounterVec
+
+	tunnelCounter              *prometheus.CounterVec
+	tunnelBytesReceivedCounter *prometheus.CounterVec
+	tunnelBytesSentCounter     *prometheus.CounterVec
+	tunnelSizeHistogram        *prometheus.HistogramVec
+
+	proxyDialHistogram      prometheus.Histogram
+	proxyConnectHistogram   prometheus.Histogram
+	firstByteHistogram      prometheus.Histogram
+	tunnelDurationHistogram prometheus.Histogram
+
+	bansDetectedCounter *prometheus.CounterVec
 )
 
 func main() {
@@ -35,6 +54,92 @@ func main() {
 	viper.BindEnv("enablePrometheusMetric", "ENABLE_PROMETHEUS_METRIC")
 	viper.BindEnv("metricPort", "METRIC_PORT")
 
+	viper.SetDefault("metricProjects", "")
+	viper.SetDefault("metricMaxProjects", 100)
+	viper.SetDefault("metricMaxProxies", 1000)
+	viper.SetDefault("metricMaxDomains", 100)
+
+	viper.BindEnv("metricProjects", "METRIC_PROJECTS")
+	viper.BindEnv("metricMaxProjects", "METRIC_MAX_PROJECTS")
+	viper.BindEnv("metricMaxProxies", "METRIC_MAX_PROXIES")
+	viper.BindEnv("metricMaxDomains", "METRIC_MAX_DOMAINS")
+
+	viper.SetDefault("latencyBuckets", "")
+	viper.SetDefault("tunnelDurationBuckets", "1,5,15,30,60,120,300,600,1800,3600")
+
+	viper.BindEnv("latencyBuckets", "LATENCY_BUCKETS")
+	viper.BindEnv("tunnelDurationBuckets", "TUNNEL_DURATION_BUCKETS")
+
+	viper.SetDefault("enableSocks", false)
+	viper.SetDefault("socksPort", ":1080")
+	viper.SetDefault("socksHandshakeTimeout", 10*time.Second)
+
+	viper.BindEnv("enableSocks", "ENABLE_SOCKS")
+	viper.BindEnv("socksPort", "SOCKS_PORT")
+	viper.BindEnv("socksHandshakeTimeout", "SOCKS_HANDSHAKE_TIMEOUT")
+
+	viper.SetDefault("proxySelector", SelectorOldest)
+	viper.BindEnv("proxySelector", "PROXY_SELECTOR")
+
+	viper.SetDefault("sessionStore", "memory")
+	viper.SetDefault("sessionTTL", 10*time.Minute)
+
+	viper.BindEnv("sessionStore", "SESSION_STORE")
+	viper.BindEnv("sessionTTL", "SESSION_TTL")
+
+	viper.SetDefault("connectRetries", 2)
+	viper.SetDefault("connectTimeout", 30*time.Second)
+
+	viper.BindEnv("connectRetries", "CONNECT_RETRIES")
+	viper.BindEnv("connectTimeout", "CONNECT_TIMEOUT")
+
+	viper.SetDefault("tunnelIdleTimeout", 10*time.Minute)
+	viper.SetDefault("tunnelMaxDuration", 0)
+
+	viper.BindEnv("tunnelIdleTimeout", "TUNNEL_IDLE_TIMEOUT")
+	viper.BindEnv("tunnelMaxDuration", "TUNNEL_MAX_DURATION")
+
+	viper.SetDefault("forwardPlainHTTP", false)
+	viper.BindEnv("forwardPlainHTTP", "FORWARD_PLAIN_HTTP")
+
+	viper.SetDefault("mitmCACert", "")
+	viper.SetDefault("mitmCAKey", "")
+	viper.SetDefault("mitmSkipVerify", false)
+	viper.SetDefault("banCooldown", 10*time.Minute)
+
+	viper.BindEnv("mitmCACert", "MITM_CA_CERT")
+	viper.BindEnv("mitmCAKey", "MITM_CA_KEY")
+	viper.BindEnv("mitmSkipVerify", "MITM_SKIP_VERIFY")
+	viper.BindEnv("banCooldown", "BAN_COOLDOWN")
+
+	viper.SetDefault("quarantineThreshold", 3)
+	viper.SetDefault("quarantineBackoff", 30*time.Second)
+	viper.SetDefault("quarantineMaxBackoff", 10*time.Minute)
+
+	viper.BindEnv("quarantineThreshold", "QUARANTINE_THRESHOLD")
+	viper.BindEnv("quarantineBackoff", "QUARANTINE_BACKOFF")
+	viper.BindEnv("quarantineMaxBackoff", "QUARANTINE_MAX_BACKOFF")
+
+	viper.SetDefault("proxyPoolSize", 0)
+	viper.SetDefault("proxyPoolIdleTimeout", 30*time.Second)
+
+	viper.BindEnv("proxyPoolSize", "PROXY_POOL_SIZE")
+	viper.BindEnv("proxyPoolIdleTimeout", "PROXY_POOL_IDLE_TIMEOUT")
+
+	viper.SetDefault("repositoryCache", false)
+	viper.SetDefault("cachePollInterval", 5*time.Second)
+	viper.SetDefault("cacheFlushInterval", time.Second)
+
+	viper.BindEnv("repositoryCache", "REPOSITORY_CACHE")
+	viper.BindEnv("cachePollInterval", "CACHE_POLL_INTERVAL")
+	viper.BindEnv("cacheFlushInterval", "CACHE_FLUSH_INTERVAL")
+
+	viper.SetDefault("enableReadiness", true)
+	viper.SetDefault("shutdownTimeout", 30*time.Second)
+
+	viper.BindEnv("enableReadiness", "ENABLE_READINESS")
+	viper.BindEnv("shutdownTimeout", "SHUTDOWN_TIMEOUT")
+
 	viper.SetDefault("testMode", false)
 	viper.BindEnv("testMode", "TEST_MODE")
 
@@ -42,42 +147,195 @@ func main() {
 	defer cancel()
 	client, err := mongo.Connect(ctx, options.Client().ApplyURI(viper.GetString("mongodbURI")))
 	defer func() {
-		if err = client.Disconnect(ctx); err != nil {
+		if err = client.Disconnect(context.Background()); err != nil {
 			panic(err)
 		}
 	}()
 
-	repository := NewMongoRepository(client, viper.GetString("mongodbDB"))
-	err = repository.Ping()
+	stats := NewProxyStats()
+	health := NewProxyHealth(viper.GetInt("quarantineThreshold"), viper.GetDuration("quarantineBackoff"), viper.GetDuration("quarantineMaxBackoff"))
+	selection, err := NewSelection(viper.GetString("proxySelector"), stats)
 	if err != nil {
 		log.Fatal(err)
 	}
+	selection.AddFilter(health)
+	cooldowns := NewDomainCooldowns()
+	selection.AddFilter(cooldowns)
+	selection.AddSoftFilter(ReuseDelayFilter{stats: stats})
 
-	handler := NewHandler(repository, viper.GetBool("testMode"))
+	mongoRepository := NewMongoRepository(client, viper.GetString("mongodbDB"), selection)
+	err = mongoRepository.Ping()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if viper.GetBool("enablePrometheusMetric") {
-		requestCounter = prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: "scrapoxy",
-			Subsystem: "proxy_dispatcher",
-			Name:      "requests_count",
-		})
-		errorCounter = prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: "scrapoxy",
-			Subsystem: "proxy_dispatcher",
-			Name:      "errors_count",
-		})
-		bytesReceivedCounter = prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: "scrapoxy",
-			Subsystem: "proxy_dispatcher",
-			Name:      "bytes_received",
-		})
-		bytesSentCounter = prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: "scrapoxy",
-			Subsystem: "proxy_dispatcher",
-			Name:      "bytes_sent",
-		})
+	var repository Repository = mongoRepository
+	var cachedRepository *CachedRepository
+	if viper.GetBool("repositoryCache") {
+		cachedRepository = NewCachedRepository(mongoRepository, viper.GetDuration("cachePollInterval"), viper.GetDuration("cacheFlushInterval"))
+		err = cachedRepository.Start(context.Background())
+		if err != nil {
+			log.Fatal(err)
+		}
+		repository = cachedRepository
+	}
+
+	var sessions SessionStore
+	switch viper.GetString("sessionStore") {
+	case "memory":
+		sessions = NewMemorySessionStore()
+	case "mongo":
+		sessions, err = NewMongoSessionStore(client, viper.GetString("mongodbDB"))
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("Unknown session store %s", viper.GetString("sessionStore"))
+	}
+
+	pool := NewProxyPool(viper.GetInt("proxyPoolSize"), viper.GetDuration("proxyPoolIdleTimeout"), viper.GetDuration("connectTimeout"), stats)
+
+	readiness := &utils.Readiness{}
+	tracker := utils.NewConnTracker()
+	// The series of the values that leave the top are deleted, the vectors are created below.
+	projectLabels := NewLabelLimiter(utils.SplitList(viper.GetString("metricProjects")), viper.GetInt("metricMaxProjects"))
+	projectLabels.OnEvict(func(project string) {
+		deleteSeries("project", project, rejectedCounter.MetricVec, tunnelCounter.MetricVec, tunnelBytesReceivedCounter.MetricVec, tunnelBytesSentCounter.MetricVec, tunnelSizeHistogram.MetricVec)
+	})
+	proxyLabels := NewLabelLimiter(nil, viper.GetInt("metricMaxProxies"))
+	proxyLabels.OnEvict(func(proxy string) {
+		deleteSeries("proxy", proxy, tunnelCounter.MetricVec, tunnelBytesReceivedCounter.MetricVec, tunnelBytesSentCounter.MetricVec)
+	})
+	domainLabels := NewLabelLimiter(nil, viper.GetInt("metricMaxDomains"))
+	domainLabels.OnEvict(func(domain string) {
+		deleteSeries("domain", domain, bansDetectedCounter.MetricVec)
+	})
+	labels := NewMetricLabels(projectLabels, proxyLabels)
+
+	bans := NewBanMiddleware(cooldowns, domainLabels, viper.GetDuration("banCooldown"))
+	var mitm *MITM
+	if viper.GetString("mitmCACert") != "" {
+		ca, err := NewCertificateAuthority(viper.GetString("mitmCACert"), viper.GetString("mitmCAKey"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		mitm = NewMITM(ca, viper.GetBool("mitmSkipVerify"))
+		mitm.Use(HeadersMiddleware{})
+		mitm.Use(UserAgentMiddleware{})
+		mitm.Use(bans)
+	}
+
+	handler := NewHandler(repository, stats, health, pool, sessions, NewProjectLimiter(), labels, tracker, mitm, HandlerConfig{
+		SessionTTL:            viper.GetDuration("sessionTTL"),
+		ConnectRetries:        viper.GetInt("connectRetries"),
+		ConnectTimeout:        viper.GetDuration("connectTimeout"),
+		IdleTimeout:           viper.GetDuration("tunnelIdleTimeout"),
+		MaxTunnelDuration:     viper.GetDuration("tunnelMaxDuration"),
+		SocksHandshakeTimeout: viper.GetDuration("socksHandshakeTimeout"),
+		ForwardPlainHTTP:      viper.GetBool("forwardPlainHTTP"),
+		TestMode:              viper.GetBool("testMode"),
+	})
+	handler.Use(HeadersMiddleware{})
+	handler.Use(UserAgentMiddleware{})
+	handler.Use(bans)
+
+	// The counters always exist so that the handler can use them, they are only exposed when
+	// the metrics are enabled.
+	requestCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "scrapoxy",
+		Subsystem: "proxy_dispatcher",
+		Name:      "requests_count",
+	})
+	errorCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "scrapoxy",
+		Subsystem: "proxy_dispatcher",
+		Name:      "errors_count",
+	})
+	bytesReceivedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "scrapoxy",
+		Subsystem: "proxy_dispatcher",
+		Name:      "bytes_received",
+	})
+	bytesSentCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "scrapoxy",
+		Subsystem: "proxy_dispatcher",
+		Name:      "bytes_sent",
+	})
+
+	retryCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "scrapoxy",
+		Subsystem: "proxy_dispatcher",
+		Name:      "connect_retries",
+	}, []string{"code"})
+	rejectedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "scrapoxy",
+		Subsystem: "proxy_dispatcher",
+		Name:      "rejected_count",
+	}, []string{"project", "code"})
+
+	tunnelCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "scrapoxy",
+		Subsystem: "proxy_dispatcher",
+		Name:      "tunnels_count",
+	}, []string{"project", "proxy", "host_class", "outcome"})
+	tunnelBytesReceivedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "scrapoxy",
+		Subsystem: "proxy_dispatcher",
+		Name:      "tunnel_bytes_received",
+	}, []string{"project", "proxy", "host_class"})
+	tunnelBytesSentCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "scrapoxy",
+		Subsystem: "proxy_dispatcher",
+		Name:      "tunnel_bytes_sent",
+	}, []string{"project", "proxy", "host_class"})
+	tunnelSizeHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "scrapoxy",
+		Subsystem: "proxy_dispatcher",
+		Name:      "tunnel_size_bytes",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+	}, []string{"project", "host_class"})
+
+	latencyBuckets, err := utils.ParseBuckets(viper.GetString("latencyBuckets"), prometheus.DefBuckets)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tunnelDurationBuckets, err := utils.ParseBuckets(viper.GetString("tunnelDurationBuckets"), prometheus.DefBuckets)
+	if err != nil {
+		log.Fatal(err)
+	}
+	proxyDialHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "scrapoxy",
+		Subsystem: "proxy_dispatcher",
+		Name:      "proxy_dial_seconds",
+		Buckets:   latencyBuckets,
+	})
+	proxyConnectHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "scrapoxy",
+		Subsystem: "proxy_dispatcher",
+		Name:      "proxy_connect_seconds",
+		Buckets:   latencyBuckets,
+	})
+	firstByteHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "scrapoxy",
+		Subsystem: "proxy_dispatcher",
+		Name:      "first_byte_seconds",
+		Buckets:   latencyBuckets,
+	})
+	tunnelDurationHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "scrapoxy",
+		Subsystem: "proxy_dispatcher",
+		Name:      "tunnel_duration_seconds",
+		Buckets:   tunnelDurationBuckets,
+	})
 
-		extraCollector := NewCollector(repository, "scrapoxy", "proxy_dispatcher")
+	bansDetectedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "scrapoxy",
+		Subsystem: "proxy_dispatcher",
+		Name:      "bans_detected",
+	}, []string{"domain"})
+
+	if viper.GetBool("enablePrometheusMetric") {
+		extraCollector := NewCollector(repository, health, "scrapoxy", "proxy_dispatcher")
 
 		c := collector.Collector{
 			Namespace: "scrapoxy",
@@ -87,20 +345,70 @@ func main() {
 		}
 		prometheus.MustRegister(collector.NewPrometheusMetrics(c, extraCollector))
 		http.Handle("/metrics", promhttp.Handler())
+	}
+
+	if viper.GetBool("enableReadiness") {
+		http.Handle("/ready", readiness)
+	}
+
+	if viper.GetBool("enablePrometheusMetric") || viper.GetBool("enableReadiness") {
 		log.Printf("Starting metric server on %s\n", viper.GetString("metricPort"))
 		go http.ListenAndServe(viper.GetString("metricPort"), nil)
 	}
 
+	var socksListener net.Listener
+	if viper.GetBool("enableSocks") {
+		socksListener, err = net.Listen("tcp", viper.GetString("socksPort"))
+		if err != nil {
+			log.Fatal("Error starting socks server: ", err)
+		}
+		log.Printf("Starting socks server on %s\n", viper.GetString("socksPort"))
+		go func() {
+			err := handler.ServeSocks(socksListener)
+			if err != nil && !readiness.Draining() {
+				log.Fatal("Error serving socks server: ", err)
+			}
+		}()
+	}
+
 	// Create a new HTTP server with the handleRequest function as the handler
 	server := http.Server{
 		Addr:    viper.GetString("proxyManagerPort"),
 		Handler: http.HandlerFunc(handler.handleRequest),
 	}
 
+	signalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
 	// Start the server and log any errors
-	log.Printf("Starting proxy server on %s\n", viper.GetString("proxyManagerPort"))
-	err = server.ListenAndServe()
-	if err != nil {
-		log.Fatal("Error starting proxy server: ", err)
+	go func() {
+		log.Printf("Starting proxy server on %s\n", viper.GetString("proxyManagerPort"))
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal("Error starting proxy server: ", err)
+		}
+	}()
+
+	<-signalCtx.Done()
+	stop()
+	log.Printf("Draining connections for up to %s\n", viper.GetDuration("shutdownTimeout"))
+	readiness.SetDraining()
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), viper.GetDuration("shutdownTimeout"))
+	defer cancelShutdown()
+	if socksListener != nil {
+		socksListener.Close()
+	}
+	if err = server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Could not drain proxy server: %s\n", err)
+	}
+	if closed := tracker.Drain(shutdownCtx); closed > 0 {
+		log.Printf("Closed %d tunnels still open after the shutdown timeout\n", closed)
+	}
+	if cachedRepository != nil {
+		if err = cachedRepository.Flush(context.Background()); err != nil {
+			log.Printf("Could not flush proxy connections: %s\n", err)
+		}
 	}
+	log.Println("Proxy server stopped")
 }
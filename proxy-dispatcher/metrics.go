@@ -0,0 +1,175 @@
+package main
+
+import (
+	"cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// otherLabel replaces the label values dropped to bound the cardinality of the metrics.
+const otherLabel = "other"
+
+// labelRankInterval is how often a LabelLimiter halves the hits of the values it counts
+// and ranks them again.
+const labelRankInterval = time.Minute
+
+// labelCandidates is how many values a LabelLimiter counts for each value it keeps.
+const labelCandidates = 10
+
+// LabelLimiter bounds the distinct values a metric label can take. When an allow-list is
+// given, only its values are kept. Otherwise the maxValues values with the most hits
+// lately are kept, 0 meaning no limit: the hits are halved every labelRankInterval, when
+// the values are ranked again. Every other value is aggregated under "other".
+type LabelLimiter struct {
+	mutex     sync.Mutex
+	allow     []string
+	maxValues int
+	hits      map[string]float64
+	top       map[string]bool
+	ranked    time.Time
+	onEvict   func(value string)
+}
+
+func NewLabelLimiter(allow []string, maxValues int) *LabelLimiter {
+	return &LabelLimiter{
+		allow:     allow,
+		maxValues: maxValues,
+		hits:      make(map[string]float64),
+		top:       make(map[string]bool),
+		ranked:    time.Now(),
+	}
+}
+
+// OnEvict sets the function called with the values that leave the top, so that the series
+// they label can be deleted.
+func (l *LabelLimiter) OnEvict(f func(value string)) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.onEvict = f
+}
+
+// Value returns the label value to use for v.
+func (l *LabelLimiter) Value(v string) string {
+	if len(l.allow) > 0 {
+		if slices.Contains(l.allow, v) {
+			return v
+		}
+		return otherLabel
+	}
+	if l.maxValues <= 0 {
+		return v
+	}
+	return l.value(v, time.Now())
+}
+
+func (l *LabelLimiter) value(v string, now time.Time) string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if now.Sub(l.ranked) >= labelRankInterval {
+		l.rank(now)
+	}
+	if _, ok := l.hits[v]; ok || len(l.hits) < l.maxValues*labelCandidates {
+		l.hits[v]++
+	}
+	// Until the next ranking, a new value only gets a free place.
+	if !l.top[v] && len(l.top) < l.maxValues {
+		l.top[v] = true
+	}
+	if l.top[v] {
+		return v
+	}
+	return otherLabel
+}
+
+// rank halves the hits, forgets the values barely seen and keeps the maxValues values with
+// the most hits. The caller must hold the mutex.
+func (l *LabelLimiter) rank(now time.Time) {
+	l.ranked = now
+	var values []string
+	for v, hits := range l.hits {
+		hits /= 2
+		if hits < 0.5 {
+			delete(l.hits, v)
+			continue
+		}
+		l.hits[v] = hits
+		values = append(values, v)
+	}
+	// On a tie, the values already kept stay.
+	slices.SortFunc(values, func(a, b string) int {
+		if c := cmp.Compare(l.hits[b], l.hits[a]); c != 0 {
+			return c
+		}
+		if l.top[a] != l.top[b] {
+			if l.top[a] {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a, b)
+	})
+
+	top := make(map[string]bool)
+	for _, v := range values[:min(len(values), l.maxValues)] {
+		top[v] = true
+	}
+	for v := range l.top {
+		if !top[v] && l.onEvict != nil {
+			l.onEvict(v)
+		}
+	}
+	l.top = top
+}
+
+// deleteSeries deletes the series of the vectors with the label value, once a LabelLimiter
+// folds the value under "other".
+func deleteSeries(label, value string, vecs ...*prometheus.MetricVec) {
+	for _, vec := range vecs {
+		vec.DeletePartialMatch(prometheus.Labels{label: value})
+	}
+}
+
+// MetricLabels computes the labels of the per-tunnel metrics.
+type MetricLabels struct {
+	projects *LabelLimiter
+	proxies  *LabelLimiter
+}
+
+func NewMetricLabels(projects, proxies *LabelLimiter) *MetricLabels {
+	return &MetricLabels{projects: projects, proxies: proxies}
+}
+
+// Project returns the project label.
+func (l *MetricLabels) Project(project Project) string {
+	return l.projects.Value(project.ID)
+}
+
+// Tunnel returns the project, proxy and host class labels of a tunnel. proxy is nil when
+// no proxy was picked.
+func (l *MetricLabels) Tunnel(project Project, proxy *Proxy, host string) []string {
+	proxyID := "none"
+	if proxy != nil {
+		proxyID = l.proxies.Value(proxy.ID)
+	}
+	return []string{l.Project(project), proxyID, hostClass(host)}
+}
+
+// hostClass sorts the targets by port, so that the label keeps a handful of values.
+func hostClass(host string) string {
+	_, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return otherLabel
+	}
+	switch port {
+	case "80":
+		return "http"
+	case "443":
+		return "https"
+	default:
+		return otherLabel
+	}
+}
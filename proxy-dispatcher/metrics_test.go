@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLabelLimiter_Value(t *testing.T) {
+	allow := NewLabelLimiter([]string{"a"}, 0)
+	if got := allow.Value("a"); got != "a" {
+		t.Errorf("Value(a) = %s, want a", got)
+	}
+	if got := allow.Value("b"); got != otherLabel {
+		t.Errorf("Value(b) = %s, want %s", got, otherLabel)
+	}
+
+	limited := NewLabelLimiter(nil, 2)
+	for _, v := range []string{"a", "b", "a"} {
+		if got := limited.Value(v); got != v {
+			t.Errorf("Value(%s) = %s, want %s", v, got, v)
+		}
+	}
+	if got := limited.Value("c"); got != otherLabel {
+		t.Errorf("Value(c) = %s, want %s", got, otherLabel)
+	}
+}
+
+func TestLabelLimiter_value(t *testing.T) {
+	limiter := NewLabelLimiter(nil, 1)
+	var evicted []string
+	limiter.OnEvict(func(v string) { evicted = append(evicted, v) })
+	now := time.Now()
+
+	if got := limiter.value("a", now); got != "a" {
+		t.Errorf("value(a) = %s, want a", got)
+	}
+	for i := 0; i < 5; i++ {
+		if got := limiter.value("b", now); got != otherLabel {
+			t.Errorf("value(b) = %s, want %s", got, otherLabel)
+		}
+	}
+
+	// b has more hits by the next ranking and takes the place of a.
+	now = now.Add(labelRankInterval)
+	if got := limiter.value("b", now); got != "b" {
+		t.Errorf("value(b) after ranking = %s, want b", got)
+	}
+	if got := limiter.value("a", now); got != otherLabel {
+		t.Errorf("value(a) after ranking = %s, want %s", got, otherLabel)
+	}
+	if !slices.Equal(evicted, []string{"a"}) {
+		t.Errorf("evicted = %v, want [a]", evicted)
+	}
+
+	// b stops, its hits decay until it is forgotten and a comes back.
+	for i := 0; i < 5; i++ {
+		now = now.Add(labelRankInterval)
+		limiter.value("a", now)
+	}
+	if got := limiter.value("a", now); got != "a" {
+		t.Errorf("value(a) once b is idle = %s, want a", got)
+	}
+}
+
+func Test_hostClass(t *testing.T) {
+	tests := map[string]string{
+		"example.com:443": "https",
+		"example.com:80":  "http",
+		"1.2.3.4:8080":    otherLabel,
+		"example.com":     otherLabel,
+	}
+	for host, want := range tests {
+		if got := hostClass(host); got != want {
+			t.Errorf("hostClass(%s) = %s, want %s", host, got, want)
+		}
+	}
+}
+
+// sampleCount returns the number of observations of h.
+func sampleCount(t *testing.T, h prometheus.Histogram) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := h.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestHandler_handleRequest_histograms(t *testing.T) {
+	initTestMetrics()
+	dial, connect, firstByte, duration, size := proxyDialHistogram, proxyConnectHistogram, firstByteHistogram, tunnelDurationHistogram, tunnelSizeHistogram
+	t.Cleanup(func() {
+		proxyDialHistogram, proxyConnectHistogram, firstByteHistogram, tunnelDurationHistogram, tunnelSizeHistogram = dial, connect, firstByte, duration, size
+	})
+	proxyDialHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "proxy_dial_seconds"})
+	proxyConnectHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "proxy_connect_seconds"})
+	firstByteHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "first_byte_seconds"})
+	tunnelDurationHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "tunnel_duration_seconds"})
+	tunnelSizeHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "tunnel_size_bytes", Buckets: []float64{1024}}, []string{"project", "host_class"})
+
+	repository := &testRepository{project: Project{ID: "project"}, proxies: []Proxy{newTestProxy(t, "p", echo)}}
+	h := newTestHandler(repository, HandlerConfig{})
+	server := httptest.NewServer(http.HandlerFunc(h.handleRequest))
+	t.Cleanup(server.Close)
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nProxy-Authorization: Basic dG9rZW4=\r\n\r\n"))
+	if resp, err := http.ReadResponse(reader, nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT = %v, %v, want 200", resp, err)
+	}
+	conn.Write([]byte("GET /path HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	conn.Close()
+
+	// The tunnel is recorded once the dispatcher sees it closed.
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.CollectAndCount(tunnelSizeHistogram) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for name, histogram := range map[string]prometheus.Histogram{
+		"proxy_dial_seconds":      proxyDialHistogram,
+		"proxy_connect_seconds":   proxyConnectHistogram,
+		"first_byte_seconds":      firstByteHistogram,
+		"tunnel_duration_seconds": tunnelDurationHistogram,
+	} {
+		if count := sampleCount(t, histogram); count != 1 {
+			t.Errorf("%s observations = %d, want 1", name, count)
+		}
+	}
+
+	// The size is what the proxy sent through the tunnel.
+	received := len(fmt.Sprintf("HTTP/1.1 200 OK\r\nX-User-Agent: \r\nContent-Length: %d\r\n\r\n%s", len("example.com/path"), "example.com/path"))
+	expected := fmt.Sprintf(`
+# HELP tunnel_size_bytes 
+# TYPE tunnel_size_bytes histogram
+tunnel_size_bytes_bucket{host_class="https",project="project",le="1024"} 1
+tunnel_size_bytes_bucket{host_class="https",project="project",le="+Inf"} 1
+tunnel_size_bytes_sum{host_class="https",project="project"} %d
+tunnel_size_bytes_count{host_class="https",project="project"} 1
+`, received)
+	if err := testutil.CollectAndCompare(tunnelSizeHistogram, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
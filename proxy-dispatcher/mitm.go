@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/netip"
+	"proxy/utils"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// mintedCertificateValidity is how long the certificates minted for the targets are
+	// valid, they are minted again an hour before they expire.
+	mintedCertificateValidity = 7 * 24 * time.Hour
+	// maxMintedCertificates bounds the cache of the minted certificates.
+	maxMintedCertificates = 10000
+)
+
+// CertificateAuthority mints the certificates the dispatcher presents to its clients in
+// place of the targets in MITM mode. The clients must trust the CA.
+type CertificateAuthority struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	// leafKey is shared by all the minted certificates, generating a key per target would
+	// only slow the handshakes down.
+	leafKey *ecdsa.PrivateKey
+	mutex   sync.Mutex
+	minted  map[string]*tls.Certificate
+}
+
+func NewCertificateAuthority(certFile, keyFile string) (*CertificateAuthority, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load CA key pair: %w", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("could not parse CA certificate: %w", err)
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("certificate %s is not a CA", certFile)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported CA key in %s", keyFile)
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &CertificateAuthority{
+		cert:    cert,
+		key:     key,
+		leafKey: leafKey,
+		minted:  make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// Certificate returns a certificate for the host name or IP address, minting it when the
+// cache does not hold a valid one.
+func (ca *CertificateAuthority) Certificate(name string) (*tls.Certificate, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	if cert, ok := ca.minted[name]; ok && time.Until(cert.Leaf.NotAfter) > time.Hour {
+		return cert, nil
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	notAfter := now.Add(mintedCertificateValidity)
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if addr, err := netip.ParseAddr(name); err == nil {
+		template.IPAddresses = []net.IP{addr.AsSlice()}
+	} else {
+		template.DNSNames = []string{name}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &ca.leafKey.PublicKey, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("could not mint certificate for %s: %w", name, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  ca.leafKey,
+		Leaf:        leaf,
+	}
+	if len(ca.minted) >= maxMintedCertificates {
+		clear(ca.minted)
+	}
+	ca.minted[name] = cert
+	return cert, nil
+}
+
+// Exchange is a request going through a MITM tunnel, as the middlewares see it. Response
+// is nil until the target answered.
+type Exchange struct {
+	Project  Project
+	Proxy    *Proxy
+	Host     string
+	Request  *http.Request
+	Response *http.Response
+}
+
+// Middleware inspects and changes the requests and the responses of the MITM tunnels.
+// An error answers the client in place of the target and ends the tunnel.
+type Middleware interface {
+	// HandleRequest is called before the request is sent to the target.
+	HandleRequest(exchange *Exchange) *ProxyError
+	// HandleResponse is called before the response is sent to the client.
+	HandleResponse(exchange *Exchange) *ProxyError
+}
+
+// MITM intercepts the tunnels of the projects that enable it: the dispatcher terminates
+// the TLS of the client with a certificate minted for the target, opens its own TLS
+// connection to the target through the proxy, and runs each request and response through
+// the middlewares.
+type MITM struct {
+	ca          *CertificateAuthority
+	skipVerify  bool
+	middlewares []Middleware
+}
+
+// NewMITM returns a MITM minting its certificates with ca. skipVerify disables the
+// verification of the certificates of the targets.
+func NewMITM(ca *CertificateAuthority, skipVerify bool) *MITM {
+	return &MITM{ca: ca, skipVerify: skipVerify}
+}
+
+// Use appends a middleware to the chain. The requests go through the middlewares in the
+// order they were added, the responses in the reverse order.
+func (m *MITM) Use(middleware Middleware) {
+	m.middlewares = append(m.middlewares, middleware)
+}
+
+// Enabled tells whether the tunnels of the project are intercepted. They never are when
+// the dispatcher has no CA.
+func (m *MITM) Enabled(project Project) bool {
+	return m != nil && project.MITM
+}
+
+// Serve intercepts the tunnel to exchange.Host between clientConn and proxyConn, which is
+// already connected to the target, until either side closes it. The relay options apply
+// as they do to a plain tunnel. The stats count the bytes exchanged with the proxy.
+func (m *MITM) Serve(exchange Exchange, clientConn, proxyConn net.Conn, opts utils.RelayOptions) (stats utils.RelayStats) {
+	upstreamConn := &countingConn{Conn: proxyConn}
+	defer func() {
+		stats.Sent, stats.Received = upstreamConn.written.Load(), upstreamConn.read.Load()
+	}()
+	if opts.MaxDuration > 0 {
+		timer := time.AfterFunc(opts.MaxDuration, func() {
+			past := time.Unix(1, 0)
+			clientConn.SetDeadline(past)
+			proxyConn.SetDeadline(past)
+		})
+		defer timer.Stop()
+	}
+
+	hostname, _, err := net.SplitHostPort(exchange.Host)
+	if err != nil {
+		hostname = exchange.Host
+	}
+	client := tls.Server(clientConn, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" {
+				return m.ca.Certificate(hello.ServerName)
+			}
+			return m.ca.Certificate(hostname)
+		},
+		NextProtos: []string{"http/1.1"},
+	})
+	if err = client.Handshake(); err != nil {
+		stats.SentErr = fmt.Errorf("client TLS handshake: %w", err)
+		return stats
+	}
+	serverName := client.ConnectionState().ServerName
+	if serverName == "" {
+		serverName = hostname
+	}
+	server := tls.Client(upstreamConn, &tls.Config{
+		ServerName:         serverName,
+		NextProtos:         []string{"http/1.1"},
+		InsecureSkipVerify: m.skipVerify,
+	})
+
+	clientReader := bufio.NewReader(client)
+	serverReader := bufio.NewReader(server)
+	for first := true; ; first = false {
+		if opts.IdleTimeout > 0 {
+			client.SetReadDeadline(time.Now().Add(opts.IdleTimeout))
+		}
+		req, err := http.ReadRequest(clientReader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				stats.SentErr = err
+			}
+			return stats
+		}
+		client.SetReadDeadline(time.Time{})
+		if first {
+			// The target is only reached once the client showed it speaks HTTP.
+			if err = server.Handshake(); err != nil {
+				writeErrorResponse(client, req, NewProxyError(ErrorUpstreamTLS, "TLS handshake with target failed", err))
+				stats.ReceivedErr = err
+				return stats
+			}
+		}
+
+		req.URL.Scheme = "https"
+		req.URL.Host = req.Host
+		ex := exchange
+		ex.Request = req
+		resp, perr := roundTrip(m.middlewares, &ex, server, serverReader, opts.IdleTimeout, false)
+		if perr != nil {
+			writeErrorResponse(client, req, perr)
+			stats.ReceivedErr = perr
+			return stats
+		}
+		if first && opts.OnFirstReceived != nil {
+			opts.OnFirstReceived()
+		}
+
+		// Without a length or chunked encoding, only closing the connection ends the body.
+		unknownLength := resp.ContentLength == -1 && !slices.Contains(resp.TransferEncoding, "chunked") && resp.StatusCode != http.StatusSwitchingProtocols
+		keepAlive := !req.Close && !resp.Close && !unknownLength
+		resp.Close = !keepAlive
+		err = resp.Write(client)
+		resp.Body.Close()
+		if err != nil {
+			stats.ReceivedErr = err
+			return stats
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			// Like a WebSocket, the connection does not carry HTTP anymore.
+			relayed := utils.Relay(utils.NewBufferedConn(client, clientReader), utils.NewBufferedConn(server, serverReader), utils.RelayOptions{IdleTimeout: opts.IdleTimeout})
+			stats.SentErr, stats.ReceivedErr = relayed.SentErr, relayed.ReceivedErr
+			return stats
+		}
+		if !keepAlive {
+			return stats
+		}
+	}
+}
+
+// roundTrip sends the request of the exchange to the target through the middlewares and
+// reads the response. asProxy writes the request with its absolute URI, for a proxy that
+// forwards it.
+func roundTrip(middlewares []Middleware, ex *Exchange, server net.Conn, serverReader *bufio.Reader, timeout time.Duration, asProxy bool) (*http.Response, *ProxyError) {
+	for _, middleware := range middlewares {
+		if perr := middleware.HandleRequest(ex); perr != nil {
+			return nil, perr
+		}
+	}
+
+	// Without a User-Agent, Write would send the one of Go.
+	if _, ok := ex.Request.Header["User-Agent"]; !ok {
+		ex.Request.Header["User-Agent"] = []string{""}
+	}
+	write := ex.Request.Write
+	if asProxy {
+		write = ex.Request.WriteProxy
+	}
+	if err := write(server); err != nil {
+		return nil, NewProxyError(ErrorProxyRefused, "Could not send request to target", err)
+	}
+	if timeout > 0 {
+		server.SetReadDeadline(time.Now().Add(timeout))
+	}
+	resp, err := http.ReadResponse(serverReader, ex.Request)
+	server.SetReadDeadline(time.Time{})
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, NewProxyError(ErrorUpstreamTimeout, "Target did not answer in time", err)
+		}
+		return nil, NewProxyError(ErrorProxyRefused, "Could not read response from target", err)
+	}
+
+	ex.Response = resp
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		if perr := middlewares[i].HandleResponse(ex); perr != nil {
+			resp.Body.Close()
+			return nil, perr
+		}
+	}
+	return ex.Response, nil
+}
+
+// writeErrorResponse answers the request with the error on a connection the dispatcher
+// writes to directly.
+func writeErrorResponse(conn net.Conn, r *http.Request, e *ProxyError) {
+	log.Printf("MITM request to %s failed: %s\n", r.Host, e)
+	errorCounter.Inc()
+	body := e.body(r)
+	resp := &http.Response{
+		StatusCode:    e.Status(),
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        e.header(),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+	resp.Write(conn)
+}
+
+// countingConn counts the bytes read from and written to the connection.
+type countingConn struct {
+	net.Conn
+	read    atomic.Int64
+	written atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// HeadersMiddleware sets the request headers of the project on the requests.
+type HeadersMiddleware struct{}
+
+func (HeadersMiddleware) HandleRequest(ex *Exchange) *ProxyError {
+	for name, value := range ex.Project.RequestHeaders {
+		ex.Request.Header.Set(name, value)
+	}
+	return nil
+}
+
+func (HeadersMiddleware) HandleResponse(*Exchange) *ProxyError {
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"proxy/utils"
+	"testing"
+	"time"
+)
+
+// newTestCA writes a CA key pair to a temporary directory and loads it.
+func newTestCA(t *testing.T) *CertificateAuthority {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "ca.pem")
+	keyFile := filepath.Join(dir, "ca.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	ca, err := NewCertificateAuthority(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+func TestCertificateAuthority_Certificate(t *testing.T) {
+	ca := newTestCA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	for _, name := range []string{"example.com", "127.0.0.1"} {
+		cert, err := ca.Certificate(name)
+		if err != nil {
+			t.Fatalf("Certificate(%s) = %v", name, err)
+		}
+		if _, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots}); err != nil {
+			t.Errorf("Certificate(%s) does not verify: %v", name, err)
+		}
+	}
+
+	first, _ := ca.Certificate("example.com")
+	second, _ := ca.Certificate("EXAMPLE.com.")
+	if first != second {
+		t.Errorf("Certificate() minted again a cached certificate")
+	}
+}
+
+type recordingMiddleware struct {
+	statuses []int
+}
+
+func (m *recordingMiddleware) HandleRequest(ex *Exchange) *ProxyError {
+	ex.Request.Header.Set("X-Intercepted", ex.Project.ID)
+	return nil
+}
+
+func (m *recordingMiddleware) HandleResponse(ex *Exchange) *ProxyError {
+	m.statuses = append(m.statuses, ex.Response.StatusCode)
+	return nil
+}
+
+func TestMITM_Serve(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Intercepted") + " " + r.Header.Get("X-Extra")))
+	}))
+	defer target.Close()
+
+	ca := newTestCA(t)
+	middleware := &recordingMiddleware{}
+	mitm := NewMITM(ca, true)
+	mitm.Use(HeadersMiddleware{})
+	mitm.Use(middleware)
+
+	proxyConn, err := net.Dial("tcp", target.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyConn.Close()
+	clientConn, mitmConn := net.Pipe()
+	defer clientConn.Close()
+
+	project := Project{ID: "p", MITM: true, RequestHeaders: map[string]string{"X-Extra": "extra"}}
+	done := make(chan utils.RelayStats)
+	go func() {
+		defer mitmConn.Close()
+		done <- mitm.Serve(Exchange{Project: project, Host: "example.com:443"}, mitmConn, proxyConn, utils.RelayOptions{IdleTimeout: time.Second})
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := tls.Client(clientConn, &tls.Config{ServerName: "example.com", RootCAs: roots})
+	reader := bufio.NewReader(client)
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+		if err = req.Write(client); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if string(body) != "p extra" {
+			t.Errorf("body = %q, want %q", body, "p extra")
+		}
+	}
+	client.Close()
+
+	stats := <-done
+	if stats.Sent == 0 || stats.Received == 0 {
+		t.Errorf("Sent, Received = %d, %d, want some bytes", stats.Sent, stats.Received)
+	}
+	if len(middleware.statuses) != 2 {
+		t.Errorf("responses seen = %v, want 2", middleware.statuses)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// proxyEntryRetention is how long the TLS configuration of an unused proxy is kept.
+const proxyEntryRetention = 10 * time.Minute
+
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+type proxyEntry struct {
+	fingerprint [sha256.Size]byte
+	config      *tls.Config
+	idle        []idleConn
+	dialing     int
+	lastUsed    time.Time
+}
+
+// ProxyPool caches the TLS configuration of each proxy and keeps up to maxIdle
+// connections to each proxy already established, so that a tunnel can start without a
+// TLS handshake. The cached configuration and connections are dropped when the
+// certificate Scrapoxy stored for the proxy changes.
+type ProxyPool struct {
+	mutex       sync.Mutex
+	maxIdle     int
+	idleTimeout time.Duration
+	dialTimeout time.Duration
+	stats       *ProxyStats
+	proxies     map[string]*proxyEntry
+}
+
+func NewProxyPool(maxIdle int, idleTimeout, dialTimeout time.Duration, stats *ProxyStats) *ProxyPool {
+	p := &ProxyPool{
+		maxIdle:     maxIdle,
+		idleTimeout: idleTimeout,
+		dialTimeout: dialTimeout,
+		stats:       stats,
+		proxies:     make(map[string]*proxyEntry),
+	}
+	go p.purge()
+	return p
+}
+
+// Get returns a connection to the proxy, taken from the idle connections when there is
+// one. reused tells whether the connection comes from the pool, in which case the proxy
+// may have closed it in the meantime.
+func (p *ProxyPool) Get(proxy *Proxy, address string) (conn net.Conn, reused bool, err error) {
+	p.mutex.Lock()
+	entry, err := p.entry(proxy)
+	if err != nil {
+		p.mutex.Unlock()
+		return nil, false, err
+	}
+	entry.lastUsed = time.Now()
+	for len(entry.idle) > 0 && conn == nil {
+		last := entry.idle[len(entry.idle)-1]
+		entry.idle = entry.idle[:len(entry.idle)-1]
+		if time.Since(last.since) < p.idleTimeout {
+			conn = last.conn
+		} else {
+			last.conn.Close()
+		}
+	}
+	config := entry.config
+	p.refill(proxy.ID, entry, address)
+	p.mutex.Unlock()
+
+	if conn != nil {
+		return conn, true, nil
+	}
+	conn, err = p.dial(proxy.ID, address, config)
+	return conn, false, err
+}
+
+// Dial opens a new connection to the proxy without using the idle connections.
+func (p *ProxyPool) Dial(proxy *Proxy, address string) (net.Conn, error) {
+	p.mutex.Lock()
+	entry, err := p.entry(proxy)
+	p.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return p.dial(proxy.ID, address, entry.config)
+}
+
+// entry returns the cached state of the proxy, building its TLS configuration when the
+// proxy is new or its certificate changed. The caller must hold the mutex.
+func (p *ProxyPool) entry(proxy *Proxy) (*proxyEntry, error) {
+	fingerprint := sha256.Sum256([]byte(proxy.Config.Certificate.Cert + proxy.Config.Certificate.Key))
+	entry, ok := p.proxies[proxy.ID]
+	if ok && entry.fingerprint == fingerprint {
+		return entry, nil
+	}
+
+	config, err := proxyTLSConfig(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		for _, c := range entry.idle {
+			c.conn.Close()
+		}
+	}
+	entry = &proxyEntry{fingerprint: fingerprint, config: config}
+	p.proxies[proxy.ID] = entry
+	return entry, nil
+}
+
+// refill opens connections in the background until the proxy has maxIdle of them idle
+// or being opened. The caller must hold the mutex.
+func (p *ProxyPool) refill(proxyID string, entry *proxyEntry, address string) {
+	for len(entry.idle)+entry.dialing < p.maxIdle {
+		entry.dialing++
+		go func() {
+			conn, err := p.dial(proxyID, address, entry.config)
+
+			p.mutex.Lock()
+			defer p.mutex.Unlock()
+			entry.dialing--
+			if err != nil {
+				return
+			}
+			if p.proxies[proxyID] != entry || len(entry.idle) >= p.maxIdle {
+				conn.Close()
+				return
+			}
+			entry.idle = append(entry.idle, idleConn{conn: conn, since: time.Now()})
+		}()
+	}
+}
+
+func (p *ProxyPool) dial(proxyID, address string, config *tls.Config) (net.Conn, error) {
+	start := time.Now()
+	dialer := &net.Dialer{Timeout: p.dialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, config)
+	if err != nil {
+		return nil, err
+	}
+	p.stats.ObserveLatency(proxyID, time.Since(start))
+	proxyDialHistogram.Observe(time.Since(start).Seconds())
+	return conn, nil
+}
+
+// purge closes the connections idle for too long and forgets the proxies that have not
+// been used for a while.
+func (p *ProxyPool) purge() {
+	interval := p.idleTimeout / 2
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	for range time.Tick(interval) {
+		p.prune(time.Now())
+	}
+}
+
+func (p *ProxyPool) prune(now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for id, entry := range p.proxies {
+		idle := entry.idle[:0]
+		for _, c := range entry.idle {
+			if now.Sub(c.since) < p.idleTimeout {
+				idle = append(idle, c)
+			} else {
+				c.conn.Close()
+			}
+		}
+		entry.idle = idle
+		if len(entry.idle) == 0 && entry.dialing == 0 && now.Sub(entry.lastUsed) > proxyEntryRetention {
+			delete(p.proxies, id)
+		}
+	}
+}
+
+// proxyTLSConfig builds the mTLS configuration from the certificate Scrapoxy stored for
+// the proxy.
+func proxyTLSConfig(proxy *Proxy) (*tls.Config, error) {
+	certPool := x509.NewCertPool()
+	if ok := certPool.AppendCertsFromPEM([]byte(proxy.Config.Certificate.Cert)); !ok {
+		return nil, fmt.Errorf("unable to parse proxy cert")
+	}
+
+	cert, err := tls.X509KeyPair([]byte(proxy.Config.Certificate.Cert), []byte(proxy.Config.Certificate.Key))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse proxy cert and key: %s", err.Error())
+	}
+
+	return &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		RootCAs:            certPool,
+		InsecureSkipVerify: true,
+	}, nil
+}
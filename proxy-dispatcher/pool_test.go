@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// closed tells whether conn was closed on our side.
+func closed(conn net.Conn) bool {
+	_, err := conn.Write([]byte{0})
+	return err != nil
+}
+
+// idlePipe returns the pool side of a connection the test keeps the other side of.
+func idlePipe(t *testing.T) net.Conn {
+	t.Helper()
+	conn, other := net.Pipe()
+	t.Cleanup(func() { other.Close() })
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := other.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return conn
+}
+
+func TestProxyPool_entry(t *testing.T) {
+	initTestMetrics()
+	p := NewProxyPool(0, time.Minute, 5*time.Second, NewProxyStats())
+	proxy := newTestProxy(t, "p", echo)
+	address := fmt.Sprintf("%s:%d", proxy.Config.Address.Hostname, proxy.Config.Address.Port)
+
+	conn, reused, err := p.Get(&proxy, address)
+	if err != nil || reused {
+		t.Fatalf("Get() = %v, %v, want a new connection", reused, err)
+	}
+	conn.Close()
+	config := p.proxies["p"].config
+	if conn, err = p.Dial(&proxy, address); err != nil {
+		t.Fatalf("Dial() = %v", err)
+	}
+	conn.Close()
+	if p.proxies["p"].config != config {
+		t.Errorf("config was rebuilt for the same certificate")
+	}
+
+	// A new certificate drops the configuration and the idle connections.
+	idle := idlePipe(t)
+	p.proxies["p"].idle = append(p.proxies["p"].idle, idleConn{conn: idle, since: time.Now()})
+	renewed := newTestProxy(t, "p", echo)
+	renewedAddress := fmt.Sprintf("%s:%d", renewed.Config.Address.Hostname, renewed.Config.Address.Port)
+	conn, reused, err = p.Get(&renewed, renewedAddress)
+	if err != nil || reused {
+		t.Fatalf("Get() = %v, %v, want a new connection", reused, err)
+	}
+	conn.Close()
+	if p.proxies["p"].config == config {
+		t.Errorf("config was kept after the certificate changed")
+	}
+	if !closed(idle) {
+		t.Errorf("idle connection of the previous certificate is still open")
+	}
+}
+
+func TestProxyPool_prune(t *testing.T) {
+	p := NewProxyPool(2, time.Minute, 5*time.Second, NewProxyStats())
+	now := time.Now()
+	expired, fresh := idlePipe(t), idlePipe(t)
+	p.proxies["used"] = &proxyEntry{
+		idle:     []idleConn{{conn: expired, since: now.Add(-2 * time.Minute)}, {conn: fresh, since: now}},
+		lastUsed: now,
+	}
+	p.proxies["unused"] = &proxyEntry{lastUsed: now.Add(-2 * proxyEntryRetention)}
+
+	p.prune(now)
+	if !closed(expired) {
+		t.Errorf("expired idle connection is still open")
+	}
+	if closed(fresh) {
+		t.Errorf("fresh idle connection was closed")
+	}
+	if entry, ok := p.proxies["used"]; !ok || len(entry.idle) != 1 || entry.idle[0].conn != fresh {
+		t.Errorf("idle connections of used = %v, want the fresh one", p.proxies["used"])
+	}
+	if _, ok := p.proxies["unused"]; ok {
+		t.Errorf("unused proxy was not forgotten")
+	}
+}
+
+func TestHandler_tunnelThrough_staleConnection(t *testing.T) {
+	proxy := newTestProxy(t, "p", echo)
+	h := newTestHandler(&testRepository{project: Project{ID: "project"}, proxies: []Proxy{proxy}}, HandlerConfig{})
+	address := h.proxyAddress(&proxy)
+	conn, err := h.pool.Dial(&proxy, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// The proxy closed the idle connection while it was in the pool.
+	stale, other := net.Pipe()
+	other.Close()
+	h.pool.proxies["p"].idle = []idleConn{{conn: stale, since: time.Now()}}
+
+	tunnel, perr := h.tunnelThrough(&proxy, "example.com:443", true)
+	if perr != nil {
+		t.Fatalf("tunnelThrough() = %v, want a tunnel over a new connection", perr)
+	}
+	tunnel.Close()
+	if len(h.pool.proxies["p"].idle) != 0 {
+		t.Errorf("stale connection is still idle in the pool")
+	}
+}
@@ -2,19 +2,100 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"proxy/utils"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 type Project struct {
-	ID string `bson:"_id"`
+	ID            string `bson:"_id"`
+	ProxySelector string `bson:"proxySelector"`
+	// RateLimit is the number of tunnels per second the project may open, 0 for no limit.
+	RateLimit float64 `bson:"rateLimit"`
+	// RateBurst is how many tunnels may be opened at once above RateLimit.
+	RateBurst int `bson:"rateBurst"`
+	// MaxConcurrentTunnels caps the tunnels open at the same time, 0 for no limit.
+	MaxConcurrentTunnels int `bson:"maxConcurrentTunnels"`
+	// TargetPolicy restricts the targets the project can reach, when set.
+	TargetPolicy *TargetPolicy `bson:"targetPolicy"`
+	// MITM intercepts the CONNECT tunnels of the project, which must carry HTTPS, so that
+	// the middlewares see the requests. The clients must trust the CA of the dispatcher.
+	MITM bool `bson:"mitm"`
+	// RequestHeaders are set on the requests the dispatcher can see.
+	RequestHeaders map[string]string `bson:"requestHeaders"`
+	// UserAgentPolicy is how the User-Agent of the proxy applies to the requests the
+	// dispatcher can see, one of the UserAgent constants.
+	UserAgentPolicy string `bson:"userAgentPolicy"`
+	// BanRules detect the targets banning a proxy in the responses the dispatcher can see.
+	BanRules *BanRules `bson:"banRules"`
+	// DomainReuseDelay is how long, in seconds, a proxy of the project is not picked again
+	// for the same target domain, 0 for no delay. It is counted per domain. When all the
+	// proxies are within it, the one used the longest ago is picked.
+	DomainReuseDelay int `bson:"domainReuseDelay"`
+}
+
+// TargetPolicy mirrors utils.PolicyConfig in the project document. The addresses can only
+// be checked when the target is an IP address, the proxies check the resolved ones.
+type TargetPolicy struct {
+	AllowHosts   []string `bson:"allowHosts"`
+	DenyHosts    []string `bson:"denyHosts"`
+	AllowCIDRs   []string `bson:"allowCidrs"`
+	DenyCIDRs    []string `bson:"denyCidrs"`
+	AllowPorts   []int    `bson:"allowPorts"`
+	BlockPrivate bool     `bson:"blockPrivate"`
+
+	// The policy is built from the rules once per project loaded, not on every request.
+	once   sync.Once
+	policy *utils.Policy
+	err    error
+}
+
+// Policy returns the policy of the rules, or why they are invalid.
+func (p *TargetPolicy) Policy() (*utils.Policy, error) {
+	p.once.Do(func() {
+		p.policy, p.err = utils.NewPolicy(utils.PolicyConfig{
+			AllowHosts:   p.AllowHosts,
+			DenyHosts:    p.DenyHosts,
+			AllowCIDRs:   p.AllowCIDRs,
+			DenyCIDRs:    p.DenyCIDRs,
+			AllowPorts:   p.AllowPorts,
+			BlockPrivate: p.BlockPrivate,
+		})
+	})
+	return p.policy, p.err
+}
+
+// Fingerprint is what the fingerprint-server reported about the proxy when Scrapoxy
+// checked it. ASN is 0 in the fingerprints taken before the fingerprint-server reported it.
+type Fingerprint struct {
+	IP            string  `bson:"ip"`
+	UserAgent     string  `bson:"useragent"`
+	ASN           uint    `bson:"asn"`
+	ASNName       string  `bson:"asnName"`
+	ASNNetwork    string  `bson:"asnNetwork"`
+	ContinentCode string  `bson:"continentCode"`
+	ContinentName string  `bson:"continentName"`
+	CountryCode   string  `bson:"countryCode"`
+	CountryName   string  `bson:"countryName"`
+	CityName      string  `bson:"cityName"`
+	Timezone      string  `bson:"timezone"`
+	Latitude      float64 `bson:"latitude"`
+	Longitude     float64 `bson:"longitude"`
 }
 
 type Proxy struct {
 	ID            string `bson:"_id"`
+	ProjectID     string `bson:"projectId"`
 	TransportType string `bson:"transportType"`
 	UserAgent     string `bson:"useragent"`
 	Config        struct {
@@ -27,9 +108,116 @@ type Proxy struct {
 			Key  string `bson:"key"`
 		} `bson:"certificate"`
 	} `bson:"config"`
-	Status           string `bson:"status"`
-	Requests         int    `bson:"requests"`
-	LastConnectionTs int    `bson:"lastConnectionTs"`
+	Status           string       `bson:"status"`
+	Removing         bool         `bson:"removing"`
+	Fingerprint      *Fingerprint `bson:"fingerprint"`
+	Requests         int          `bson:"requests"`
+	LastConnectionTs int          `bson:"lastConnectionTs"`
+	Weight           float64      `bson:"weight"`
+}
+
+// ErrNoProxy is returned when no proxy of the project can take the connection.
+var ErrNoProxy = errors.New("no proxy available")
+
+// ErrNoMatchingProxy is returned when proxies could take the connection but none is in the
+// location the query asks for.
+var ErrNoMatchingProxy = fmt.Errorf("%w in the requested location", ErrNoProxy)
+
+// ProxyQuery narrows the proxies GetProxyAndUpdateConnection can pick.
+type ProxyQuery struct {
+	// ProxyID restricts the selection to this proxy, if it is still available.
+	ProxyID string
+	// Exclude lists proxies that must not be picked.
+	Exclude []string
+	// Domain is the domain of the target, the filters may exclude proxies for it.
+	Domain string
+	// Geo restricts the selection to the proxies in a location.
+	Geo GeoQuery
+}
+
+// GeoQuery is a location a client asks its proxy to be in, matched against the
+// fingerprint of the proxies. The empty fields match any proxy.
+type GeoQuery struct {
+	// Country is an ISO 3166 country code, like "CA".
+	Country string
+	// Continent is a continent code, like "NA".
+	Continent string
+	// ASN is the name of the autonomous system organization, as the fingerprint reports it,
+	// or its number, like "16509" or "AS16509".
+	ASN string
+}
+
+// asnNumber returns the number of an ASN written as "16509" or "AS16509", and whether it
+// is one.
+func asnNumber(asn string) (uint, bool) {
+	if len(asn) > 2 && strings.EqualFold(asn[:2], "AS") {
+		asn = asn[2:]
+	}
+	n, err := strconv.ParseUint(asn, 10, 32)
+	return uint(n), err == nil
+}
+
+// IsZero tells whether the query matches any proxy.
+func (q GeoQuery) IsZero() bool {
+	return q == GeoQuery{}
+}
+
+// String describes the location for the error messages.
+func (q GeoQuery) String() string {
+	var parts []string
+	if q.Country != "" {
+		parts = append(parts, "country "+q.Country)
+	}
+	if q.Continent != "" {
+		parts = append(parts, "continent "+q.Continent)
+	}
+	if q.ASN != "" {
+		parts = append(parts, "ASN "+q.ASN)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Matches tells whether the fingerprint is in the location, ignoring the case.
+func (q GeoQuery) Matches(fingerprint *Fingerprint) bool {
+	if fingerprint == nil {
+		return q.IsZero()
+	}
+	return (q.Country == "" || strings.EqualFold(q.Country, fingerprint.CountryCode)) &&
+		(q.Continent == "" || strings.EqualFold(q.Continent, fingerprint.ContinentCode)) &&
+		(q.ASN == "" || q.matchesASN(fingerprint))
+}
+
+// matchesASN compares the numbers when the query is a number and the fingerprint has one,
+// the names otherwise.
+func (q GeoQuery) matchesASN(fingerprint *Fingerprint) bool {
+	if n, ok := asnNumber(q.ASN); ok && fingerprint.ASN != 0 {
+		return n == fingerprint.ASN
+	}
+	return strings.EqualFold(q.ASN, fingerprint.ASNName)
+}
+
+// conditions returns the Mongo conditions on the fingerprint matching the location.
+func (q GeoQuery) conditions() bson.A {
+	var conditions bson.A
+	if q.Country != "" {
+		conditions = append(conditions, bson.D{{"fingerprint.countryCode", strings.ToUpper(q.Country)}})
+	}
+	if q.Continent != "" {
+		conditions = append(conditions, bson.D{{"fingerprint.continentCode", strings.ToUpper(q.Continent)}})
+	}
+	if q.ASN != "" {
+		name := bson.E{"fingerprint.asnName", primitive.Regex{Pattern: "^" + regexp.QuoteMeta(q.ASN) + "$", Options: "i"}}
+		if n, ok := asnNumber(q.ASN); ok {
+			// Like Matches, the names are compared when the fingerprint has no number.
+			conditions = append(conditions, bson.D{{"$or", bson.A{
+				bson.D{{"fingerprint.asn", n}},
+				bson.D{{"fingerprint.asn", bson.D{{"$in", bson.A{0, nil}}}}, name},
+			}}})
+		} else {
+			conditions = append(conditions, bson.D{name})
+		}
+	}
+	return conditions
 }
 
 type ProxyMetrics struct {
@@ -40,7 +228,7 @@ type ProxyMetrics struct {
 type Repository interface {
 	GetProjectByToken(token string) (*Project, error)
 	//GetProxy(project Project) (*Proxy, error)
-	GetProxyAndUpdateConnection(project Project) (*Proxy, error)
+	GetProxyAndUpdateConnection(project Project, query ProxyQuery) (*Proxy, error)
 
 	GetProjectCount() int64
 	GetConnectorCount() int64
@@ -49,12 +237,13 @@ type Repository interface {
 }
 
 type MongoRepository struct {
-	client   *mongo.Client
-	database string
+	client    *mongo.Client
+	database  string
+	selection *Selection
 }
 
-func NewMongoRepository(client *mongo.Client, database string) *MongoRepository {
-	return &MongoRepository{client: client, database: database}
+func NewMongoRepository(client *mongo.Client, database string, selection *Selection) *MongoRepository {
+	return &MongoRepository{client: client, database: database, selection: selection}
 }
 
 func (r *MongoRepository) GetProjectCount() int64 {
@@ -146,34 +335,85 @@ func (r *MongoRepository) GetProxyCountByStatus() ProxyMetrics {
 //	return &proxy, err
 //}
 
-func (r *MongoRepository) GetProxyAndUpdateConnection(project Project) (*Proxy, error) {
-	filter := bson.D{
-		{"$and",
-			bson.A{
-				bson.D{{"projectId", project.ID}},
-				bson.D{{"status", "STARTED"}},
-				bson.D{{"fingerprint", bson.D{{"$ne", nil}}}},
-				bson.D{{"removing", false}},
-			}},
+func (r *MongoRepository) GetProxyAndUpdateConnection(project Project, query ProxyQuery) (*Proxy, error) {
+	proxy, err := r.pickProxy(project, query, r.selection.Excluded(project, query), r.selection.For(project))
+	if errors.Is(err, ErrNoProxy) {
+		if relaxed, fallback, ok := r.selection.Relaxed(project, query); ok {
+			return r.pickProxy(project, query, relaxed, fallback)
+		}
+	}
+	return proxy, err
+}
+
+// pickProxy selects a proxy of the project with selector, the excluded ones left out, and
+// records the connection.
+func (r *MongoRepository) pickProxy(project Project, query ProxyQuery, excluded []string, selector ProxySelector) (*Proxy, error) {
+	conditions := bson.A{
+		bson.D{{"projectId", project.ID}},
+		bson.D{{"status", "STARTED"}},
+		bson.D{{"fingerprint", bson.D{{"$ne", nil}}}},
+		bson.D{{"removing", false}},
+	}
+	if query.ProxyID != "" {
+		conditions = append(conditions, bson.D{{"_id", query.ProxyID}})
 	}
+	if len(excluded) > 0 {
+		conditions = append(conditions, bson.D{{"_id", bson.D{{"$nin", excluded}}}})
+	}
+	conditions = append(conditions, query.Geo.conditions()...)
+	noProxy := ErrNoProxy
+	if !query.Geo.IsZero() {
+		noProxy = ErrNoMatchingProxy
+	}
+	filter := bson.D{{"$and", conditions}}
 	update := bson.M{
 		"$inc": bson.M{"requests": 1},
 		"$set": bson.M{"lastConnectionTs": time.Now().Unix()},
 	}
+	coll := r.client.Database(r.database).Collection("proxies")
 
-	sort := bson.D{{"lastConnectionTs", 1}, {"requests", -1}}
-	opts := options.FindOneAndUpdate().SetSort(sort).SetUpsert(false)
-	var proxy Proxy
+	if _, ok := selector.(OldestSelector); ok {
+		// The oldest proxy can be picked and updated atomically by Mongo.
+		sort := bson.D{{"lastConnectionTs", 1}, {"requests", -1}}
+		opts := options.FindOneAndUpdate().SetSort(sort).SetUpsert(false)
+		var proxy Proxy
 
-	coll := r.client.Database(r.database).Collection("proxies")
-	err := coll.FindOneAndUpdate(context.TODO(), filter, update, opts).Decode(&proxy)
+		err := coll.FindOneAndUpdate(context.TODO(), filter, update, opts).Decode(&proxy)
+		if err == mongo.ErrNoDocuments {
+			return nil, noProxy
+		}
+		return &proxy, err
+	}
 
+	// The candidates only hold what the selectors look at, the whole document, with its
+	// certificate, is loaded for the chosen proxy only.
+	projection := bson.D{{"_id", 1}, {"requests", 1}, {"lastConnectionTs", 1}, {"weight", 1}}
+	cursor, err := coll.Find(context.TODO(), filter, options.Find().SetProjection(projection))
+	if err != nil {
+		return nil, err
+	}
+	var proxies []Proxy
+	if err = cursor.All(context.TODO(), &proxies); err != nil {
+		return nil, err
+	}
+	if len(proxies) == 0 {
+		return nil, noProxy
+	}
+
+	chosen := selector.Select(project, query, proxies)
+	var proxy Proxy
+	filter = bson.D{{"$and", append(conditions, bson.D{{"_id", chosen.ID}})}}
+	err = coll.FindOneAndUpdate(context.TODO(), filter, update).Decode(&proxy)
+	if err == mongo.ErrNoDocuments {
+		// The proxy went away since it was chosen.
+		return nil, noProxy
+	}
 	return &proxy, err
 }
 
 func (r *MongoRepository) GetProjectByToken(token string) (*Project, error) {
 	filter := bson.D{{"token", token}}
-	opts := options.FindOne().SetProjection(bson.D{{"_id", 1}})
+	opts := options.FindOne().SetProjection(bson.D{{"_id", 1}, {"proxySelector", 1}, {"rateLimit", 1}, {"rateBurst", 1}, {"maxConcurrentTunnels", 1}, {"targetPolicy", 1}, {"mitm", 1}, {"requestHeaders", 1}, {"userAgentPolicy", 1}, {"banRules", 1}, {"domainReuseDelay", 1}})
 
 	coll := r.client.Database(r.database).Collection("projects")
 	var project Project
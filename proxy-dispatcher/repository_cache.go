@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"sync"
+	"time"
+)
+
+type cachedProject struct {
+	Project `bson:",inline"`
+	Token   string `bson:"token"`
+}
+
+type changeEvent[T any] struct {
+	OperationType string `bson:"operationType"`
+	DocumentKey   struct {
+		ID string `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument *T `bson:"fullDocument"`
+}
+
+type pendingConnections struct {
+	requests         int
+	lastConnectionTs int
+}
+
+// CachedRepository keeps the projects and the started proxies in memory and selects
+// proxies locally. The cache follows the projects and proxies collections through change
+// streams, or by polling them when change streams are not available. The requests and
+// lastConnectionTs of the proxies are written back to Mongo in batches.
+type CachedRepository struct {
+	*MongoRepository
+
+	pollInterval  time.Duration
+	flushInterval time.Duration
+
+	mutex    sync.RWMutex
+	projects map[string]cachedProject
+	tokens   map[string]string
+	proxies  map[string]Proxy
+	pending  map[string]pendingConnections
+}
+
+func NewCachedRepository(repository *MongoRepository, pollInterval, flushInterval time.Duration) *CachedRepository {
+	return &CachedRepository{
+		MongoRepository: repository,
+		pollInterval:    pollInterval,
+		flushInterval:   flushInterval,
+		projects:        make(map[string]cachedProject),
+		tokens:          make(map[string]string),
+		proxies:         make(map[string]Proxy),
+		pending:         make(map[string]pendingConnections),
+	}
+}
+
+// Start loads the cache and keeps it up to date until ctx is done.
+func (r *CachedRepository) Start(ctx context.Context) error {
+	if err := r.loadProjects(ctx); err != nil {
+		return err
+	}
+	if err := r.loadProxies(ctx); err != nil {
+		return err
+	}
+	go r.follow(ctx, "projects", r.loadProjects, r.applyProjectChange)
+	go r.follow(ctx, "proxies", r.loadProxies, r.applyProxyChange)
+	go r.flushEvery(ctx)
+	return nil
+}
+
+func (r *CachedRepository) GetProjectByToken(token string) (*Project, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	id, ok := r.tokens[token]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	project := r.projects[id].Project
+	return &project, nil
+}
+
+func (r *CachedRepository) GetProxyAndUpdateConnection(project Project, query ProxyQuery) (*Proxy, error) {
+	selector := r.selection.For(project)
+	excluded := r.selection.Excluded(project, query)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	candidates := r.candidates(project, query, excluded)
+	if len(candidates) == 0 {
+		if relaxed, fallback, ok := r.selection.Relaxed(project, query); ok {
+			candidates, selector = r.candidates(project, query, relaxed), fallback
+		}
+	}
+	if len(candidates) == 0 {
+		if !query.Geo.IsZero() {
+			return nil, ErrNoMatchingProxy
+		}
+		return nil, ErrNoProxy
+	}
+
+	proxy := *selector.Select(project, query, candidates)
+	now := int(time.Now().Unix())
+	updated := r.proxies[proxy.ID]
+	updated.Requests++
+	updated.LastConnectionTs = now
+	r.proxies[proxy.ID] = updated
+
+	pending := r.pending[proxy.ID]
+	pending.requests++
+	pending.lastConnectionTs = now
+	r.pending[proxy.ID] = pending
+
+	return &proxy, nil
+}
+
+// candidates returns the proxies of the project the query can go through, the excluded
+// ones left out. The caller holds the mutex.
+func (r *CachedRepository) candidates(project Project, query ProxyQuery, excludedIDs []string) []Proxy {
+	excluded := make(map[string]bool)
+	for _, id := range excludedIDs {
+		excluded[id] = true
+	}
+	var candidates []Proxy
+	for _, proxy := range r.proxies {
+		if proxy.ProjectID != project.ID || proxy.Status != "STARTED" || proxy.Fingerprint == nil || proxy.Removing {
+			continue
+		}
+		if excluded[proxy.ID] || (query.ProxyID != "" && proxy.ID != query.ProxyID) || !query.Geo.Matches(proxy.Fingerprint) {
+			continue
+		}
+		candidates = append(candidates, proxy)
+	}
+	return candidates
+}
+
+// Flush writes the pending connections of the proxies to Mongo. The connections that
+// could not be written stay pending for the next flush.
+//
+// Each write makes the change stream send the proxy back, so the cache reloads documents
+// it just wrote itself. That is harmless, withPending adds the connections recorded since.
+func (r *CachedRepository) Flush(ctx context.Context) error {
+	r.mutex.Lock()
+	pending := r.pending
+	r.pending = make(map[string]pendingConnections)
+	r.mutex.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	var ids []string
+	var models []mongo.WriteModel
+	for id, p := range pending {
+		ids = append(ids, id)
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": id}).
+			SetUpdate(bson.M{
+				"$inc": bson.M{"requests": p.requests},
+				"$max": bson.M{"lastConnectionTs": p.lastConnectionTs},
+			}))
+	}
+	coll := r.client.Database(r.database).Collection("proxies")
+	_, err := coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		r.restore(unwritten(err, ids, pending))
+	}
+	return err
+}
+
+// unwritten returns the pending connections a failed bulk write did not write: the
+// failed writes a BulkWriteException lists, all of them for any other error.
+func unwritten(err error, ids []string, pending map[string]pendingConnections) map[string]pendingConnections {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+		return pending
+	}
+	failed := make(map[string]pendingConnections)
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.Index >= 0 && writeErr.Index < len(ids) {
+			failed[ids[writeErr.Index]] = pending[ids[writeErr.Index]]
+		}
+	}
+	return failed
+}
+
+// restore puts back connections that could not be flushed, merged with the ones recorded
+// since.
+func (r *CachedRepository) restore(failed map[string]pendingConnections) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for id, p := range failed {
+		merged := r.pending[id]
+		merged.requests += p.requests
+		merged.lastConnectionTs = max(merged.lastConnectionTs, p.lastConnectionTs)
+		r.pending[id] = merged
+	}
+}
+
+func (r *CachedRepository) flushEvery(ctx context.Context) {
+	ticker := time.NewTicker(r.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Flush(ctx); err != nil {
+				log.Printf("Could not flush proxy connections: %s\n", err)
+			}
+		}
+	}
+}
+
+// follow applies the changes of the collection to the cache. When the change stream
+// cannot be opened or breaks, the collection is reloaded every pollInterval until the
+// change stream works again.
+func (r *CachedRepository) follow(ctx context.Context, collection string, reload func(context.Context) error, apply func(bson.Raw) error) {
+	coll := r.client.Database(r.database).Collection(collection)
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	for {
+		stream, err := coll.Watch(ctx, mongo.Pipeline{}, opts)
+		if err == nil {
+			// Reload once the stream is open so that no change is missed in between.
+			err = reload(ctx)
+			for err == nil && stream.Next(ctx) {
+				err = apply(stream.Current)
+			}
+			if err == nil {
+				err = stream.Err()
+			}
+			stream.Close(context.TODO())
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Change stream on %s unavailable, polling: %s\n", collection, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.pollInterval):
+		}
+		if err := reload(ctx); err != nil {
+			log.Printf("Could not reload %s: %s\n", collection, err)
+		}
+	}
+}
+
+func (r *CachedRepository) loadProjects(ctx context.Context) error {
+	coll := r.client.Database(r.database).Collection("projects")
+	cursor, err := coll.Find(ctx, bson.D{})
+	if err != nil {
+		return err
+	}
+	var projects []cachedProject
+	if err = cursor.All(ctx, &projects); err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.projects = make(map[string]cachedProject)
+	r.tokens = make(map[string]string)
+	for _, project := range projects {
+		r.projects[project.ID] = project
+		r.tokens[project.Token] = project.ID
+	}
+	return nil
+}
+
+func (r *CachedRepository) loadProxies(ctx context.Context) error {
+	coll := r.client.Database(r.database).Collection("proxies")
+	cursor, err := coll.Find(ctx, bson.D{{"status", "STARTED"}})
+	if err != nil {
+		return err
+	}
+	var proxies []Proxy
+	if err = cursor.All(ctx, &proxies); err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.proxies = make(map[string]Proxy)
+	for _, proxy := range proxies {
+		r.proxies[proxy.ID] = r.withPending(proxy)
+	}
+	return nil
+}
+
+func (r *CachedRepository) applyProjectChange(raw bson.Raw) error {
+	var event changeEvent[cachedProject]
+	if err := bson.Unmarshal(raw, &event); err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if previous, ok := r.projects[event.DocumentKey.ID]; ok {
+		delete(r.tokens, previous.Token)
+		delete(r.projects, event.DocumentKey.ID)
+	}
+	if event.OperationType != "delete" && event.FullDocument != nil {
+		r.projects[event.DocumentKey.ID] = *event.FullDocument
+		r.tokens[event.FullDocument.Token] = event.DocumentKey.ID
+	}
+	return nil
+}
+
+func (r *CachedRepository) applyProxyChange(raw bson.Raw) error {
+	var event changeEvent[Proxy]
+	if err := bson.Unmarshal(raw, &event); err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if event.OperationType == "delete" || event.FullDocument == nil || event.FullDocument.Status != "STARTED" {
+		delete(r.proxies, event.DocumentKey.ID)
+		return nil
+	}
+	r.proxies[event.DocumentKey.ID] = r.withPending(*event.FullDocument)
+	return nil
+}
+
+// withPending adds the connections not yet flushed to a proxy read from Mongo. The caller
+// must hold the mutex.
+func (r *CachedRepository) withPending(proxy Proxy) Proxy {
+	if pending, ok := r.pending[proxy.ID]; ok {
+		proxy.Requests += pending.requests
+		proxy.LastConnectionTs = max(proxy.LastConnectionTs, pending.lastConnectionTs)
+	}
+	return proxy
+}
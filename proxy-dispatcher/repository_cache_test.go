@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_unwritten(t *testing.T) {
+	ids := []string{"a", "b"}
+	pending := map[string]pendingConnections{
+		"a": {requests: 1, lastConnectionTs: 10},
+		"b": {requests: 2, lastConnectionTs: 20},
+	}
+
+	if got := unwritten(errors.New("connection reset"), ids, pending); !reflect.DeepEqual(got, pending) {
+		t.Errorf("unwritten(network error) = %v, want all", got)
+	}
+	bulkErr := mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{{WriteError: mongo.WriteError{Index: 1}}}}
+	want := map[string]pendingConnections{"b": pending["b"]}
+	if got := unwritten(bulkErr, ids, pending); !reflect.DeepEqual(got, want) {
+		t.Errorf("unwritten(write error) = %v, want %v", got, want)
+	}
+}
+
+func TestCachedRepository_restore(t *testing.T) {
+	r := NewCachedRepository(nil, 0, 0)
+	r.pending["a"] = pendingConnections{requests: 1, lastConnectionTs: 30}
+
+	r.restore(map[string]pendingConnections{
+		"a": {requests: 2, lastConnectionTs: 10},
+		"b": {requests: 3, lastConnectionTs: 20},
+	})
+	want := map[string]pendingConnections{
+		"a": {requests: 3, lastConnectionTs: 30},
+		"b": {requests: 3, lastConnectionTs: 20},
+	}
+	if !reflect.DeepEqual(r.pending, want) {
+		t.Errorf("pending = %v, want %v", r.pending, want)
+	}
+}
+
+func TestCachedRepository_Flush_writeError(t *testing.T) {
+	// Nothing listens on the port, the writes fail once no server is found.
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://127.0.0.1:1").SetServerSelectionTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	selection, err := NewSelection(SelectorOldest, NewProxyStats())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewCachedRepository(NewMongoRepository(client, "scrapoxy", selection), 0, 0)
+	r.proxies["a"] = Proxy{ID: "a", ProjectID: "p", Status: "STARTED", Fingerprint: &Fingerprint{}}
+	project := Project{ID: "p"}
+	if _, err = r.GetProxyAndUpdateConnection(project, ProxyQuery{}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() { done <- r.Flush(context.Background()) }()
+	// A connection recorded while the batch is being written.
+	for {
+		r.mutex.RLock()
+		taken := len(r.pending) == 0
+		r.mutex.RUnlock()
+		if taken {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err = r.GetProxyAndUpdateConnection(project, ProxyQuery{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = <-done; err == nil {
+		t.Fatalf("Flush() = nil, want an error")
+	}
+	// The batch is merged with the connection recorded since, not replaced by it.
+	if got := r.pending["a"]; got.requests != 2 || got.lastConnectionTs == 0 {
+		t.Errorf("pending = %+v, want the 2 connections", got)
+	}
+}
+
+func TestCachedRepository_GetProxyAndUpdateConnection_reuseDelay(t *testing.T) {
+	stats := NewProxyStats()
+	selection, err := NewSelection(SelectorOldest, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selection.AddSoftFilter(ReuseDelayFilter{stats: stats})
+	r := NewCachedRepository(NewMongoRepository(nil, "", selection), 0, 0)
+	for _, id := range []string{"a", "b"} {
+		r.proxies[id] = Proxy{ID: id, ProjectID: "p", Status: "STARTED", Fingerprint: &Fingerprint{}}
+	}
+	project := Project{ID: "p", DomainReuseDelay: 60}
+	query := ProxyQuery{Domain: "example.com"}
+
+	// Within the delay of both proxies, the one used the longest ago is picked.
+	var got []string
+	for i := 0; i < 3; i++ {
+		proxy, err := r.GetProxyAndUpdateConnection(project, query)
+		if err != nil {
+			t.Fatalf("GetProxyAndUpdateConnection() = %v", err)
+		}
+		stats.RecordUse(proxy.ID, query.Domain)
+		got = append(got, proxy.ID)
+		time.Sleep(time.Millisecond)
+	}
+	if got[2] != got[0] || got[1] == got[0] {
+		t.Errorf("GetProxyAndUpdateConnection() sequence = %v, want the least recently used", got)
+	}
+
+	// The soft filter does not bring back the proxies a hard exclusion keeps out.
+	if _, err = r.GetProxyAndUpdateConnection(project, ProxyQuery{Domain: "example.com", Exclude: []string{"a", "b"}}); !errors.Is(err, ErrNoProxy) {
+		t.Errorf("GetProxyAndUpdateConnection() = %v, want ErrNoProxy", err)
+	}
+}
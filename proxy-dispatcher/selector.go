@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	SelectorOldest           = "oldest"
+	SelectorLeastConnections = "least-connections"
+	SelectorWeightedRandom   = "weighted-random"
+	SelectorLatency          = "latency"
+	SelectorRoundRobin       = "round-robin"
+	SelectorDomainLRU        = "domain-lru"
+)
+
+// ProxySelector picks the proxy a new connection goes through among the available
+// proxies of a project. proxies is never empty.
+type ProxySelector interface {
+	Select(project Project, query ProxyQuery, proxies []Proxy) *Proxy
+}
+
+// ProxyFilter removes proxies from the selection before the selector runs.
+type ProxyFilter interface {
+	Excluded(project Project, query ProxyQuery) []string
+}
+
+// Selection holds the selectors the dispatcher knows and resolves the one a project uses.
+type Selection struct {
+	selectors       map[string]ProxySelector
+	defaultSelector string
+	filters         []ProxyFilter
+	softFilters     []ProxyFilter
+}
+
+func NewSelection(defaultSelector string, stats *ProxyStats) (*Selection, error) {
+	s := &Selection{
+		selectors: map[string]ProxySelector{
+			SelectorOldest:           OldestSelector{},
+			SelectorLeastConnections: LeastConnectionsSelector{stats: stats},
+			SelectorWeightedRandom:   WeightedRandomSelector{},
+			SelectorLatency:          LatencySelector{stats: stats},
+			SelectorRoundRobin:       &RoundRobinSelector{next: make(map[string]int)},
+			SelectorDomainLRU:        DomainLRUSelector{stats: stats},
+		},
+		defaultSelector: defaultSelector,
+	}
+	if _, ok := s.selectors[defaultSelector]; !ok {
+		return nil, fmt.Errorf("unknown proxy selector %q", defaultSelector)
+	}
+	return s, nil
+}
+
+// For returns the selector configured on the project, or the default one when the
+// project does not set any or sets an unknown one.
+func (s *Selection) For(project Project) ProxySelector {
+	if selector, ok := s.selectors[project.ProxySelector]; ok {
+		return selector
+	}
+	return s.selectors[s.defaultSelector]
+}
+
+// AddFilter registers a filter applied to every selection.
+func (s *Selection) AddFilter(filter ProxyFilter) {
+	s.filters = append(s.filters, filter)
+}
+
+// AddSoftFilter registers a filter the selection gives up when it leaves no proxy.
+func (s *Selection) AddSoftFilter(filter ProxyFilter) {
+	s.softFilters = append(s.softFilters, filter)
+}
+
+// Excluded returns the proxies the query excludes along with the ones the filters exclude.
+func (s *Selection) Excluded(project Project, query ProxyQuery) []string {
+	excluded := s.hardExcluded(project, query)
+	for _, filter := range s.softFilters {
+		excluded = append(excluded, filter.Excluded(project, query)...)
+	}
+	return excluded
+}
+
+// Relaxed returns the proxies excluded without the soft filters, and the selector picking
+// among them: the proxy used the longest ago for the domain of the target comes first, the
+// closest to leaving the soft filters. ok is false when the soft filters exclude nothing,
+// relaxing them would not make any proxy available.
+func (s *Selection) Relaxed(project Project, query ProxyQuery) (excluded []string, selector ProxySelector, ok bool) {
+	for _, filter := range s.softFilters {
+		if len(filter.Excluded(project, query)) > 0 {
+			ok = true
+		}
+	}
+	if !ok {
+		return nil, nil, false
+	}
+	return s.hardExcluded(project, query), s.selectors[SelectorDomainLRU], true
+}
+
+func (s *Selection) hardExcluded(project Project, query ProxyQuery) []string {
+	excluded := slices.Clone(query.Exclude)
+	for _, filter := range s.filters {
+		excluded = append(excluded, filter.Excluded(project, query)...)
+	}
+	return excluded
+}
+
+// OldestSelector picks the proxy that has not been used for the longest time, then the
+// most used one. This is the historical behaviour of the dispatcher.
+type OldestSelector struct{}
+
+func (OldestSelector) Select(project Project, query ProxyQuery, proxies []Proxy) *Proxy {
+	best := &proxies[0]
+	for i := range proxies[1:] {
+		if older(&proxies[i+1], best) {
+			best = &proxies[i+1]
+		}
+	}
+	return best
+}
+
+func older(a, b *Proxy) bool {
+	if a.LastConnectionTs != b.LastConnectionTs {
+		return a.LastConnectionTs < b.LastConnectionTs
+	}
+	return a.Requests > b.Requests
+}
+
+// LeastConnectionsSelector picks the proxy with the fewest tunnels currently open.
+type LeastConnectionsSelector struct {
+	stats *ProxyStats
+}
+
+func (s LeastConnectionsSelector) Select(project Project, query ProxyQuery, proxies []Proxy) *Proxy {
+	best := &proxies[0]
+	for i := range proxies[1:] {
+		p := &proxies[i+1]
+		active, bestActive := s.stats.Active(p.ID), s.stats.Active(best.ID)
+		if active < bestActive || (active == bestActive && older(p, best)) {
+			best = p
+		}
+	}
+	return best
+}
+
+// WeightedRandomSelector picks a proxy at random, proportionally to its weight.
+// Proxies without a weight count as 1.
+type WeightedRandomSelector struct{}
+
+func (WeightedRandomSelector) Select(project Project, query ProxyQuery, proxies []Proxy) *Proxy {
+	total := 0.0
+	for _, p := range proxies {
+		total += weight(p)
+	}
+	n := rand.Float64() * total
+	for i := range proxies {
+		n -= weight(proxies[i])
+		if n < 0 {
+			return &proxies[i]
+		}
+	}
+	return &proxies[len(proxies)-1]
+}
+
+func weight(p Proxy) float64 {
+	if p.Weight <= 0 {
+		return 1
+	}
+	return p.Weight
+}
+
+// LatencySelector picks the proxy that opened tunnels the fastest recently. Proxies that
+// were never used have no latency yet and are tried first.
+type LatencySelector struct {
+	stats *ProxyStats
+}
+
+func (s LatencySelector) Select(project Project, query ProxyQuery, proxies []Proxy) *Proxy {
+	best := &proxies[0]
+	for i := range proxies[1:] {
+		p := &proxies[i+1]
+		latency, bestLatency := s.stats.Latency(p.ID), s.stats.Latency(best.ID)
+		if latency < bestLatency || (latency == bestLatency && older(p, best)) {
+			best = p
+		}
+	}
+	return best
+}
+
+// RoundRobinSelector cycles through the proxies of each project in a stable order.
+type RoundRobinSelector struct {
+	mutex sync.Mutex
+	next  map[string]int
+}
+
+func (s *RoundRobinSelector) Select(project Project, query ProxyQuery, proxies []Proxy) *Proxy {
+	// The proxies of the caller are left in their order.
+	proxies = slices.Clone(proxies)
+	sort.Slice(proxies, func(i, j int) bool { return proxies[i].ID < proxies[j].ID })
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	i := s.next[project.ID] % len(proxies)
+	s.next[project.ID] = i + 1
+	return &proxies[i]
+}
+
+// DomainLRUSelector picks the proxy that has not been used for the domain of the target
+// for the longest time, which spreads the requests to a site evenly across the proxies.
+type DomainLRUSelector struct {
+	stats *ProxyStats
+}
+
+func (s DomainLRUSelector) Select(project Project, query ProxyQuery, proxies []Proxy) *Proxy {
+	best := &proxies[0]
+	bestUsed := s.stats.LastUsed(best.ID, query.Domain)
+	for i := range proxies[1:] {
+		p := &proxies[i+1]
+		used := s.stats.LastUsed(p.ID, query.Domain)
+		if used.Before(bestUsed) || (used.Equal(bestUsed) && older(p, best)) {
+			best, bestUsed = p, used
+		}
+	}
+	return best
+}
+
+// ReuseDelayFilter keeps the proxies used for the domain of the target within the reuse
+// delay out of the selection. The delay is set per project, in DomainReuseDelay, and
+// counted per domain: a proxy just used for a domain can be picked right away for another
+// one. A session asking for its proxy is not affected. It is a soft filter: when every
+// proxy was used within the delay, the one used the longest ago is picked rather than none.
+type ReuseDelayFilter struct {
+	stats *ProxyStats
+}
+
+func (f ReuseDelayFilter) Excluded(project Project, query ProxyQuery) []string {
+	if project.DomainReuseDelay <= 0 || query.Domain == "" || query.ProxyID != "" {
+		return nil
+	}
+	return f.stats.UsedSince(query.Domain, time.Now().Add(-time.Duration(project.DomainReuseDelay)*time.Second))
+}
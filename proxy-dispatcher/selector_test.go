@@ -0,0 +1,165 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSelectors(t *testing.T) {
+	stats := NewProxyStats()
+	stats.Acquire("a")
+	stats.Acquire("a")
+	stats.Acquire("b")
+	stats.ObserveLatency("a", 50*time.Millisecond)
+	stats.ObserveLatency("b", 10*time.Millisecond)
+	stats.ObserveLatency("c", 30*time.Millisecond)
+
+	proxies := func() []Proxy {
+		return []Proxy{
+			{ID: "a", LastConnectionTs: 10, Requests: 5},
+			{ID: "b", LastConnectionTs: 5, Requests: 1},
+			{ID: "c", LastConnectionTs: 5, Requests: 3},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		selector ProxySelector
+		want     string
+	}{
+		{name: "oldest", selector: OldestSelector{}, want: "c"},
+		{name: "least-connections", selector: LeastConnectionsSelector{stats: stats}, want: "c"},
+		{name: "latency", selector: LatencySelector{stats: stats}, want: "b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.selector.Select(Project{ID: "p"}, ProxyQuery{}, proxies()); got.ID != tt.want {
+				t.Errorf("Select() = %s, want %s", got.ID, tt.want)
+			}
+		})
+	}
+
+	t.Run("round-robin", func(t *testing.T) {
+		selector := &RoundRobinSelector{next: make(map[string]int)}
+		var got []string
+		for i := 0; i < 4; i++ {
+			got = append(got, selector.Select(Project{ID: "p"}, ProxyQuery{}, proxies()).ID)
+		}
+		if got[0] != "a" || got[1] != "b" || got[2] != "c" || got[3] != "a" {
+			t.Errorf("Select() sequence = %v", got)
+		}
+
+		// The proxies are cycled in the order of their IDs, the caller keeps its order.
+		unsorted := []Proxy{{ID: "c"}, {ID: "a"}, {ID: "b"}}
+		if got := selector.Select(Project{ID: "p"}, ProxyQuery{}, unsorted); got.ID != "b" {
+			t.Errorf("Select() = %s, want b", got.ID)
+		}
+		if unsorted[0].ID != "c" || unsorted[1].ID != "a" || unsorted[2].ID != "b" {
+			t.Errorf("Select() reordered the proxies to %v", unsorted)
+		}
+	})
+
+	t.Run("weighted-random", func(t *testing.T) {
+		weighted := []Proxy{{ID: "a", Weight: 0.000001}, {ID: "b", Weight: 1000000}}
+		if got := (WeightedRandomSelector{}).Select(Project{ID: "p"}, ProxyQuery{}, weighted); got.ID != "b" {
+			t.Errorf("Select() = %s, want b", got.ID)
+		}
+	})
+}
+
+func TestDomainLRUSelector(t *testing.T) {
+	stats := NewProxyStats()
+	selector := DomainLRUSelector{stats: stats}
+	proxies := []Proxy{{ID: "a"}, {ID: "b"}, {ID: "c"}}
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		proxy := selector.Select(Project{ID: "p"}, ProxyQuery{Domain: "example.com"}, proxies)
+		stats.RecordUse(proxy.ID, "example.com")
+		got = append(got, proxy.ID)
+		time.Sleep(time.Millisecond)
+	}
+	if got[0] != "a" || got[1] != "b" || got[2] != "c" || got[3] != "a" {
+		t.Errorf("Select() sequence = %v", got)
+	}
+	if proxy := selector.Select(Project{ID: "p"}, ProxyQuery{Domain: "example.org"}, proxies); proxy.ID != "a" {
+		t.Errorf("Select() for another domain = %s, want a", proxy.ID)
+	}
+}
+
+func TestReuseDelayFilter_Excluded(t *testing.T) {
+	stats := NewProxyStats()
+	stats.RecordUse("a", "example.com")
+	filter := ReuseDelayFilter{stats: stats}
+	project := Project{ID: "p", DomainReuseDelay: 60}
+
+	if got := filter.Excluded(project, ProxyQuery{Domain: "example.com"}); len(got) != 1 || got[0] != "a" {
+		t.Errorf("Excluded() = %v, want [a]", got)
+	}
+	if got := filter.Excluded(project, ProxyQuery{Domain: "example.org"}); len(got) != 0 {
+		t.Errorf("Excluded() for another domain = %v, want none", got)
+	}
+	if got := filter.Excluded(project, ProxyQuery{Domain: "example.com", ProxyID: "a"}); len(got) != 0 {
+		t.Errorf("Excluded() for a session = %v, want none", got)
+	}
+	if got := filter.Excluded(Project{ID: "p"}, ProxyQuery{Domain: "example.com"}); len(got) != 0 {
+		t.Errorf("Excluded() without delay = %v, want none", got)
+	}
+}
+
+func TestSelectionFor(t *testing.T) {
+	selection, err := NewSelection(SelectorOldest, NewProxyStats())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := selection.For(Project{ProxySelector: SelectorLatency}).(LatencySelector); !ok {
+		t.Errorf("For() did not use the project selector")
+	}
+	if _, ok := selection.For(Project{ProxySelector: "unknown"}).(OldestSelector); !ok {
+		t.Errorf("For() did not fall back to the default selector")
+	}
+	if _, err = NewSelection("unknown", NewProxyStats()); err == nil {
+		t.Errorf("NewSelection() accepted an unknown selector")
+	}
+}
+
+func TestSelection_Relaxed(t *testing.T) {
+	stats := NewProxyStats()
+	selection, err := NewSelection(SelectorOldest, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selection.AddSoftFilter(ReuseDelayFilter{stats: stats})
+	project := Project{ID: "p", DomainReuseDelay: 60}
+	query := ProxyQuery{Domain: "example.com", Exclude: []string{"c"}}
+
+	if _, _, ok := selection.Relaxed(project, query); ok {
+		t.Errorf("Relaxed() = true without soft exclusions, want false")
+	}
+	stats.RecordUse("a", "example.com")
+	if got := selection.Excluded(project, query); !slices.Equal(got, []string{"c", "a"}) {
+		t.Errorf("Excluded() = %v, want [c a]", got)
+	}
+	excluded, selector, ok := selection.Relaxed(project, query)
+	if !ok || !slices.Equal(excluded, []string{"c"}) {
+		t.Errorf("Relaxed() = %v, %v, want [c], true", excluded, ok)
+	}
+	if _, isLRU := selector.(DomainLRUSelector); !isLRU {
+		t.Errorf("Relaxed() selector = %T, want DomainLRUSelector", selector)
+	}
+
+	// When every proxy is within the delay, the one used the longest ago is picked.
+	time.Sleep(time.Millisecond)
+	stats.RecordUse("b", "example.com")
+	proxies := []Proxy{{ID: "b"}, {ID: "a"}}
+	if got := selection.Excluded(project, query); !slices.Contains(got, "a") || !slices.Contains(got, "b") {
+		t.Errorf("Excluded() = %v, want a and b within the delay", got)
+	}
+	if _, selector, ok = selection.Relaxed(project, query); !ok {
+		t.Fatalf("Relaxed() = false, want true")
+	}
+	if got := selector.Select(project, query, proxies); got.ID != "a" {
+		t.Errorf("Select() = %s, want a, used the longest ago", got.ID)
+	}
+}
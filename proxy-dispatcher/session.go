@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"sync"
+	"time"
+)
+
+// SessionStore remembers which proxy a client session is pinned to.
+type SessionStore interface {
+	Get(key string) (string, bool)
+	Set(key, proxyID string, ttl time.Duration)
+	Delete(key string)
+}
+
+type memorySession struct {
+	proxyID   string
+	expiresAt time.Time
+}
+
+// MemorySessionStore keeps the sessions of a single dispatcher in memory.
+type MemorySessionStore struct {
+	mutex    sync.RWMutex
+	sessions map[string]memorySession
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	s := &MemorySessionStore{sessions: make(map[string]memorySession)}
+	go s.purge(time.Minute)
+	return s
+}
+
+func (s *MemorySessionStore) Get(key string) (string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	session, ok := s.sessions[key]
+	if !ok || time.Now().After(session.expiresAt) {
+		return "", false
+	}
+	return session.proxyID, true
+}
+
+func (s *MemorySessionStore) Set(key, proxyID string, ttl time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sessions[key] = memorySession{proxyID: proxyID, expiresAt: time.Now().Add(ttl)}
+}
+
+func (s *MemorySessionStore) Delete(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, key)
+}
+
+// purge removes the expired sessions every interval.
+func (s *MemorySessionStore) purge(interval time.Duration) {
+	for range time.Tick(interval) {
+		now := time.Now()
+		s.mutex.Lock()
+		for key, session := range s.sessions {
+			if now.After(session.expiresAt) {
+				delete(s.sessions, key)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// MongoSessionStore shares the sessions between dispatcher replicas through a Mongo
+// collection. Expired sessions are removed by a TTL index.
+type MongoSessionStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoSessionStore(client *mongo.Client, database string) (*MongoSessionStore, error) {
+	collection := client.Database(database).Collection("dispatcherSessions")
+	index := mongo.IndexModel{
+		Keys:    bson.D{{"expiresAt", 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}
+	if _, err := collection.Indexes().CreateOne(context.TODO(), index); err != nil {
+		return nil, err
+	}
+	return &MongoSessionStore{collection: collection}, nil
+}
+
+func (s *MongoSessionStore) Get(key string) (string, bool) {
+	var session struct {
+		ProxyID string `bson:"proxyId"`
+	}
+	filter := bson.M{"_id": key, "expiresAt": bson.M{"$gt": time.Now()}}
+	err := s.collection.FindOne(context.TODO(), filter).Decode(&session)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Printf("Could not get session: %s\n", err)
+		}
+		return "", false
+	}
+	return session.ProxyID, true
+}
+
+func (s *MongoSessionStore) Set(key, proxyID string, ttl time.Duration) {
+	update := bson.M{"$set": bson.M{"proxyId": proxyID, "expiresAt": time.Now().Add(ttl)}}
+	opts := options.Update().SetUpsert(true)
+	if _, err := s.collection.UpdateByID(context.TODO(), key, update, opts); err != nil {
+		log.Printf("Could not save session: %s\n", err)
+	}
+}
+
+func (s *MongoSessionStore) Delete(key string) {
+	if _, err := s.collection.DeleteOne(context.TODO(), bson.M{"_id": key}); err != nil {
+		log.Printf("Could not delete session: %s\n", err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemorySessionStore(t *testing.T) {
+	s := NewMemorySessionStore()
+	s.Set("a", "p0", time.Minute)
+	s.Set("b", "p1", -time.Second)
+
+	if got, ok := s.Get("a"); !ok || got != "p0" {
+		t.Errorf("Get(a) = %s, %v, want p0, true", got, ok)
+	}
+	if got, ok := s.Get("b"); ok {
+		t.Errorf("Get(expired) = %s, want none", got)
+	}
+	s.Delete("a")
+	if got, ok := s.Get("a"); ok {
+		t.Errorf("Get(deleted) = %s, want none", got)
+	}
+}
+
+func TestHandler_selectProxy_session(t *testing.T) {
+	tests := []struct {
+		name string
+		// lose makes the pinned proxy unavailable, it returns the proxies to exclude.
+		lose func(r *CachedRepository, pinned string) []string
+	}{
+		{name: "stopped", lose: func(r *CachedRepository, pinned string) []string {
+			proxy := r.proxies[pinned]
+			proxy.Status = "STOPPED"
+			r.proxies[pinned] = proxy
+			return nil
+		}},
+		{name: "removing", lose: func(r *CachedRepository, pinned string) []string {
+			proxy := r.proxies[pinned]
+			proxy.Removing = true
+			r.proxies[pinned] = proxy
+			return nil
+		}},
+		{name: "failed attempt", lose: func(r *CachedRepository, pinned string) []string {
+			return []string{pinned}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selection, err := NewSelection(SelectorRoundRobin, NewProxyStats())
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := NewCachedRepository(NewMongoRepository(nil, "", selection), 0, 0)
+			for _, id := range []string{"p0", "p1", "p2"} {
+				r.proxies[id] = Proxy{ID: id, ProjectID: "project", Status: "STARTED", Fingerprint: &Fingerprint{}}
+			}
+			h := newTestHandler(r, HandlerConfig{SessionTTL: time.Minute})
+			project := Project{ID: "project"}
+			credentials := Credentials{Session: "s"}
+
+			// The round robin would move to the next proxy without the session.
+			first, err := h.selectProxy(project, credentials, "example.com", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				proxy, err := h.selectProxy(project, credentials, "example.com", nil)
+				if err != nil || proxy.ID != first.ID {
+					t.Fatalf("selectProxy() = %v, %v, want the pinned %s", proxy, err, first.ID)
+				}
+			}
+
+			exclude := tt.lose(r, first.ID)
+			repinned, err := h.selectProxy(project, credentials, "example.com", exclude)
+			if err != nil || repinned.ID == first.ID {
+				t.Fatalf("selectProxy() = %v, %v, want another proxy than %s", repinned, err, first.ID)
+			}
+			if pinned, _ := h.sessions.Get("project:s"); pinned != repinned.ID {
+				t.Errorf("session pinned to %s, want %s", pinned, repinned.ID)
+			}
+			if proxy, err := h.selectProxy(project, credentials, "example.com", nil); err != nil || proxy.ID != repinned.ID {
+				t.Errorf("selectProxy() = %v, %v, want the new pinned %s", proxy, err, repinned.ID)
+			}
+		})
+	}
+}
+
+func TestHandler_selectProxy_sessionLost(t *testing.T) {
+	selection, err := NewSelection(SelectorOldest, NewProxyStats())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewCachedRepository(NewMongoRepository(nil, "", selection), 0, 0)
+	r.proxies["p0"] = Proxy{ID: "p0", ProjectID: "project", Status: "STARTED", Fingerprint: &Fingerprint{}}
+	h := newTestHandler(r, HandlerConfig{SessionTTL: time.Minute})
+	project := Project{ID: "project"}
+	credentials := Credentials{Session: "s"}
+
+	if _, err = h.selectProxy(project, credentials, "example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	delete(r.proxies, "p0")
+	if proxy, err := h.selectProxy(project, credentials, "example.com", nil); err == nil {
+		t.Fatalf("selectProxy() = %s, want no proxy", proxy.ID)
+	}
+	if pinned, ok := h.sessions.Get("project:s"); ok {
+		t.Errorf("session still pinned to %s, want none", pinned)
+	}
+}
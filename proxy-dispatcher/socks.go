@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol constants (RFC 1928 and RFC 1929).
+const (
+	socksVersion         = 0x05
+	socksAuthVersion     = 0x01
+	socksMethodUserPass  = 0x02
+	socksMethodNoAccept  = 0xff
+	socksCmdConnect      = 0x01
+	socksAtypIPv4        = 0x01
+	socksAtypDomain      = 0x03
+	socksAtypIPv6        = 0x04
+	socksAuthSuccess     = 0x00
+	socksAuthFailure     = 0x01
+	socksReplySucceeded  = 0x00
+	socksReplyFailure    = 0x01
+	socksReplyNotAllowed = 0x02
+	socksReplyHostUnreac = 0x04
+	socksReplyTTLExpired = 0x06
+	socksReplyCmdUnsupp  = 0x07
+	socksReplyAtypUnsupp = 0x08
+)
+
+// ServeSocks accepts SOCKS5 clients on l until the listener is closed.
+func (h Handler) ServeSocks(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go h.handleSocks(conn)
+	}
+}
+
+// handleSocks authenticates a SOCKS5 client with its project token and tunnels its
+// CONNECT request through a proxy of that project.
+func (h Handler) handleSocks(clientConn net.Conn) {
+	defer clientConn.Close()
+	defer h.tracker.Track(clientConn)()
+	requestCounter.Inc()
+
+	// A client that connects and sends nothing must not hold the connection forever.
+	if h.config.SocksHandshakeTimeout > 0 {
+		clientConn.SetReadDeadline(time.Now().Add(h.config.SocksHandshakeTimeout))
+	}
+	username, password, err := socksHandshake(clientConn)
+	if err != nil {
+		log.Printf("SOCKS handshake failed: %s\n", err)
+		errorCounter.Inc()
+		return
+	}
+
+	credentials := parseUsernameOptions(username)
+	credentials.Token = password
+
+	project, err := h.repository.GetProjectByToken(credentials.Token)
+	if err != nil {
+		log.Printf("Could not get project: %s\n", err)
+		clientConn.Write([]byte{socksAuthVersion, socksAuthFailure})
+		errorCounter.Inc()
+		return
+	}
+	if _, err = clientConn.Write([]byte{socksAuthVersion, socksAuthSuccess}); err != nil {
+		errorCounter.Inc()
+		return
+	}
+
+	host, reply, err := socksReadRequest(clientConn)
+	if err != nil {
+		log.Printf("SOCKS request failed: %s\n", err)
+		socksReply(clientConn, reply)
+		errorCounter.Inc()
+		return
+	}
+	clientConn.SetReadDeadline(time.Time{})
+
+	if perr := checkTarget(*project, host); perr != nil {
+		h.countTunnel(*project, nil, host, perr.Code)
+		socksReply(clientConn, socksReplyFor(perr))
+		errorCounter.Inc()
+		return
+	}
+
+	release, perr := h.limiter.Acquire(*project)
+	if perr != nil {
+		rejectedCounter.WithLabelValues(h.labels.Project(*project), perr.Code).Inc()
+		h.countTunnel(*project, nil, host, perr.Code)
+		socksReply(clientConn, socksReplyFor(perr))
+		errorCounter.Inc()
+		return
+	}
+	defer release()
+
+	proxy, proxyConn, perr := h.openTunnel(*project, credentials, host, true)
+	if perr != nil {
+		log.Printf("Could not open tunnel: %s\n", perr)
+		socksReply(clientConn, socksReplyFor(perr))
+		errorCounter.Inc()
+		return
+	}
+	defer proxyConn.Close()
+
+	if err = socksReply(clientConn, socksReplySucceeded); err != nil {
+		errorCounter.Inc()
+		return
+	}
+
+	h.pipe(*project, proxy, host, clientConn, proxyConn)
+}
+
+// socksHandshake negotiates the username/password method and reads the credentials.
+// The caller must answer the sub-negotiation once the credentials are checked.
+func socksHandshake(conn net.Conn) (string, string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", "", err
+	}
+	if header[0] != socksVersion {
+		return "", "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", "", err
+	}
+	supported := false
+	for _, m := range methods {
+		if m == socksMethodUserPass {
+			supported = true
+		}
+	}
+	if !supported {
+		conn.Write([]byte{socksVersion, socksMethodNoAccept})
+		return "", "", errors.New("client does not support username/password authentication")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksMethodUserPass}); err != nil {
+		return "", "", err
+	}
+
+	// RFC 1929: VER | ULEN | UNAME | PLEN | PASSWD
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", "", err
+	}
+	if header[0] != socksAuthVersion {
+		return "", "", fmt.Errorf("unsupported SOCKS auth version %d", header[0])
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return "", "", err
+	}
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return "", "", err
+	}
+	password := make([]byte, length[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return "", "", err
+	}
+	return string(username), string(password), nil
+}
+
+// socksReadRequest reads a SOCKS5 request and returns its destination as host:port.
+// On failure it also returns the reply code the client should receive.
+func socksReadRequest(conn net.Conn) (string, byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", socksReplyFailure, err
+	}
+	if header[0] != socksVersion {
+		return "", socksReplyFailure, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	if header[1] != socksCmdConnect {
+		return "", socksReplyCmdUnsupp, fmt.Errorf("unsupported SOCKS command %d", header[1])
+	}
+
+	var host string
+	switch header[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		size := net.IPv4len
+		if header[3] == socksAtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", socksReplyFailure, err
+		}
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return "", socksReplyFailure, err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", socksReplyFailure, err
+		}
+		host = string(domain)
+	default:
+		return "", socksReplyAtypUnsupp, fmt.Errorf("unsupported SOCKS address type %d", header[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", socksReplyFailure, err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), socksReplySucceeded, nil
+}
+
+// socksReplyFor maps the dispatcher error codes to SOCKS5 reply codes.
+func socksReplyFor(perr *ProxyError) byte {
+	switch perr.Code {
+	case ErrorProxyRefused, ErrorTargetUnreachable:
+		return socksReplyHostUnreac
+	case ErrorUpstreamTimeout:
+		return socksReplyTTLExpired
+	case ErrorRateLimited, ErrorTooManyTunnels, ErrorTargetDenied:
+		return socksReplyNotAllowed
+	default:
+		return socksReplyFailure
+	}
+}
+
+// socksReply answers a SOCKS5 request. The bound address is not meaningful for a
+// tunnel through a remote proxy, so it is always reported as 0.0.0.0:0.
+func socksReply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socksVersion, reply, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"proxy/utils"
+	"testing"
+	"time"
+)
+
+func TestHandler_handleSocks_handshakeTimeout(t *testing.T) {
+	initTestMetrics()
+	h := Handler{tracker: utils.NewConnTracker(), config: HandlerConfig{SocksHandshakeTimeout: 50 * time.Millisecond}}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	done := make(chan struct{})
+	go func() {
+		h.handleSocks(serverConn)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handleSocks() still waits for a silent client")
+	}
+}
+
+// expect reads len(want) bytes from conn and compares them to want.
+func expect(t *testing.T, conn net.Conn, want []byte) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("Read() = %v, want %v", err, want)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("Read() = %v, want %v", got, want)
+	}
+}
+
+func TestSocksHandshake_methods(t *testing.T) {
+	tests := []struct {
+		name    string
+		methods []byte
+		reply   []byte
+	}{
+		{name: "username/password", methods: []byte{0x00, socksMethodUserPass}, reply: []byte{socksVersion, socksMethodUserPass}},
+		{name: "no authentication only", methods: []byte{0x00}, reply: []byte{socksVersion, socksMethodNoAccept}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+			type result struct {
+				username, password string
+				err                error
+			}
+			done := make(chan result, 1)
+			go func() {
+				username, password, err := socksHandshake(serverConn)
+				serverConn.Close()
+				done <- result{username, password, err}
+			}()
+
+			clientConn.Write(append([]byte{socksVersion, byte(len(tt.methods))}, tt.methods...))
+			expect(t, clientConn, tt.reply)
+			if tt.reply[1] == socksMethodNoAccept {
+				if r := <-done; r.err == nil {
+					t.Errorf("socksHandshake() = nil, want an error")
+				}
+				return
+			}
+			clientConn.Write([]byte{socksAuthVersion, 4, 'u', 's', 'e', 'r', 5, 't', 'o', 'k', 'e', 'n'})
+			if r := <-done; r.err != nil || r.username != "user" || r.password != "token" {
+				t.Errorf("socksHandshake() = %q, %q, %v, want user, token", r.username, r.password, r.err)
+			}
+		})
+	}
+}
+
+// socksConnect authenticates with token on a SOCKS5 connection served by h, and returns
+// the client side of it. The server side is closed when handleSocks returns.
+func socksConnect(t *testing.T, h *Handler, token string) net.Conn {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	go h.handleSocks(serverConn)
+
+	clientConn.Write([]byte{socksVersion, 1, socksMethodUserPass})
+	expect(t, clientConn, []byte{socksVersion, socksMethodUserPass})
+	auth := append([]byte{socksAuthVersion, 4}, "user"...)
+	auth = append(append(auth, byte(len(token))), token...)
+	clientConn.Write(auth)
+	return clientConn
+}
+
+// socksRequest sends a CONNECT request to host:port.
+func socksRequest(conn net.Conn, host string, port uint16) {
+	request := append([]byte{socksVersion, socksCmdConnect, 0x00, socksAtypDomain, byte(len(host))}, host...)
+	conn.Write(binary.BigEndian.AppendUint16(request, port))
+}
+
+func TestHandler_handleSocks_authFailure(t *testing.T) {
+	h := newTestHandler(&testRepository{token: "token", project: Project{ID: "project"}}, HandlerConfig{})
+	conn := socksConnect(t, h, "wrong")
+
+	expect(t, conn, []byte{socksAuthVersion, socksAuthFailure})
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("Read() = %v, want the connection closed", err)
+	}
+}
+
+func TestHandler_handleSocks_connect(t *testing.T) {
+	repository := &testRepository{
+		token:   "token",
+		project: Project{ID: "project", TargetPolicy: &TargetPolicy{DenyHosts: []string{"denied.example"}}},
+		proxies: []Proxy{newTestProxy(t, "p", echo)},
+	}
+	h := newTestHandler(repository, HandlerConfig{})
+
+	// A denied target is answered without going through a proxy.
+	conn := socksConnect(t, h, "token")
+	expect(t, conn, []byte{socksAuthVersion, socksAuthSuccess})
+	socksRequest(conn, "denied.example", 443)
+	expect(t, conn, []byte{socksVersion, socksReplyNotAllowed, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	if len(repository.queries) != 0 {
+		t.Errorf("proxies tried = %d, want 0", len(repository.queries))
+	}
+
+	conn = socksConnect(t, h, "token")
+	expect(t, conn, []byte{socksAuthVersion, socksAuthSuccess})
+	socksRequest(conn, "example.com", 80)
+	expect(t, conn, []byte{socksVersion, socksReplySucceeded, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+
+	// The tunnel reaches the proxy, which echoes the target of the request.
+	conn.Write([]byte("GET /path HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	body := "example.com/path"
+	response := make([]byte, 128)
+	n, err := io.ReadAtLeast(conn, response, len(body))
+	if err != nil || !bytes.HasSuffix(response[:n], []byte(body)) {
+		t.Errorf("tunnel response = %q, %v, want a body of %q", response[:n], err, body)
+	}
+}
+
+func TestSocksReplyFor(t *testing.T) {
+	tests := []struct {
+		code  string
+		reply byte
+	}{
+		{ErrorProxyRefused, socksReplyHostUnreac},
+		{ErrorTargetUnreachable, socksReplyHostUnreac},
+		{ErrorUpstreamTimeout, socksReplyTTLExpired},
+		{ErrorRateLimited, socksReplyNotAllowed},
+		{ErrorTooManyTunnels, socksReplyNotAllowed},
+		{ErrorTargetDenied, socksReplyNotAllowed},
+		{ErrorNoProxy, socksReplyFailure},
+		{ErrorProxyDialFailed, socksReplyFailure},
+		{ErrorUpstreamTLS, socksReplyFailure},
+	}
+	for _, tt := range tests {
+		if reply := socksReplyFor(NewProxyError(tt.code, "", nil)); reply != tt.reply {
+			t.Errorf("socksReplyFor(%s) = %#x, want %#x", tt.code, reply, tt.reply)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// latencySmoothing is the weight of a new sample in the latency moving average.
+const latencySmoothing = 0.3
+
+// domainUsageRetention is how long the use of a proxy for a domain is remembered.
+const domainUsageRetention = time.Hour
+
+// maxUsageDomains bounds the domains whose usages are remembered. Past it, the domains
+// used the longest ago are forgotten even within the retention.
+const maxUsageDomains = 10000
+
+// ProxyStats keeps the per proxy figures the dispatcher observes itself and that are not
+// stored by Scrapoxy: the tunnels currently open, the time it takes to open one and when
+// the proxy was last picked for each target domain.
+type ProxyStats struct {
+	mutex   sync.RWMutex
+	active  map[string]int64
+	latency map[string]time.Duration
+	used    map[string]map[string]time.Time
+}
+
+func NewProxyStats() *ProxyStats {
+	s := &ProxyStats{
+		active:  make(map[string]int64),
+		latency: make(map[string]time.Duration),
+		used:    make(map[string]map[string]time.Time),
+	}
+	go s.purge(time.Minute)
+	return s
+}
+
+// Acquire records a new tunnel opened through the proxy.
+func (s *ProxyStats) Acquire(proxyID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.active[proxyID]++
+}
+
+// Release records the end of a tunnel opened with Acquire.
+func (s *ProxyStats) Release(proxyID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.active[proxyID]--
+	if s.active[proxyID] <= 0 {
+		delete(s.active, proxyID)
+	}
+}
+
+// ObserveLatency adds a sample of the time needed to open a tunnel through the proxy.
+func (s *ProxyStats) ObserveLatency(proxyID string, d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	previous, ok := s.latency[proxyID]
+	if !ok {
+		s.latency[proxyID] = d
+		return
+	}
+	s.latency[proxyID] = time.Duration(latencySmoothing*float64(d) + (1-latencySmoothing)*float64(previous))
+}
+
+// Active returns the number of tunnels currently open through the proxy.
+func (s *ProxyStats) Active(proxyID string) int64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.active[proxyID]
+}
+
+// Latency returns the moving average of the time needed to open a tunnel through the
+// proxy, or 0 when the proxy was never used.
+func (s *ProxyStats) Latency(proxyID string) time.Duration {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.latency[proxyID]
+}
+
+// RecordUse records that the proxy was picked for the domain now.
+func (s *ProxyStats) RecordUse(proxyID, domain string) {
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	proxies, ok := s.used[domain]
+	if !ok {
+		if len(s.used) >= maxUsageDomains {
+			s.evict(now)
+		}
+		proxies = make(map[string]time.Time)
+		s.used[domain] = proxies
+	}
+	proxies[proxyID] = now
+}
+
+// purge forgets the usages older than the retention every interval.
+func (s *ProxyStats) purge(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.mutex.Lock()
+		s.prune(time.Now())
+		s.mutex.Unlock()
+	}
+}
+
+// prune forgets the usages older than the retention. The caller holds the mutex.
+func (s *ProxyStats) prune(now time.Time) {
+	for domain, proxies := range s.used {
+		for id, at := range proxies {
+			if now.Sub(at) > domainUsageRetention {
+				delete(proxies, id)
+			}
+		}
+		if len(proxies) == 0 {
+			delete(s.used, domain)
+		}
+	}
+}
+
+// evict makes room for a new domain. When pruning is not enough, the tenth of the domains
+// used the longest ago are forgotten. The caller holds the mutex.
+func (s *ProxyStats) evict(now time.Time) {
+	s.prune(now)
+	if len(s.used) < maxUsageDomains {
+		return
+	}
+	type domainUse struct {
+		domain string
+		last   time.Time
+	}
+	uses := make([]domainUse, 0, len(s.used))
+	for domain, proxies := range s.used {
+		use := domainUse{domain: domain}
+		for _, at := range proxies {
+			if at.After(use.last) {
+				use.last = at
+			}
+		}
+		uses = append(uses, use)
+	}
+	slices.SortFunc(uses, func(a, b domainUse) int { return a.last.Compare(b.last) })
+	for _, use := range uses[:len(uses)-maxUsageDomains*9/10] {
+		delete(s.used, use.domain)
+	}
+}
+
+// LastUsed returns when the proxy was last picked for the domain, the zero time when it
+// never was.
+func (s *ProxyStats) LastUsed(proxyID, domain string) time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.used[domain][proxyID]
+}
+
+// UsedSince returns the proxies picked for the domain after since. The uses are recorded
+// per domain only, the caller passes the reuse delay of the project as since.
+func (s *ProxyStats) UsedSince(domain string, since time.Time) []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var proxies []string
+	for id, at := range s.used[domain] {
+		if at.After(since) {
+			proxies = append(proxies, id)
+		}
+	}
+	return proxies
+}
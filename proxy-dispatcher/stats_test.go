@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestProxyStats_RecordUse(t *testing.T) {
+	s := NewProxyStats()
+	now := time.Now()
+	for i := 0; i < maxUsageDomains; i++ {
+		s.used[fmt.Sprintf("%d.example.com", i)] = map[string]time.Time{"a": now.Add(time.Duration(i-maxUsageDomains) * time.Millisecond)}
+	}
+	s.used["old.example.com"] = map[string]time.Time{"a": now.Add(-2 * domainUsageRetention)}
+
+	s.RecordUse("a", "new.example.com")
+	if len(s.used) > maxUsageDomains {
+		t.Errorf("domains = %d, want at most %d", len(s.used), maxUsageDomains)
+	}
+	for domain, want := range map[string]bool{"old.example.com": false, "0.example.com": false, "9999.example.com": true, "new.example.com": true} {
+		if _, got := s.used[domain]; got != want {
+			t.Errorf("used[%s] = %v, want %v", domain, got, want)
+		}
+	}
+
+	s.prune(now.Add(domainUsageRetention + time.Minute))
+	if len(s.used) != 0 {
+		t.Errorf("domains after the retention = %d, want 0", len(s.used))
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import "net/http"
+
+// The policies a project can apply to the User-Agent of the requests the dispatcher sees.
+const (
+	// UserAgentKeep sends the User-Agent of the client. This is the default.
+	UserAgentKeep = "keep"
+	// UserAgentOverwrite replaces the User-Agent of the client with the one of the proxy,
+	// so that the IP and the User-Agent of a proxy always go together.
+	UserAgentOverwrite = "overwrite"
+	// UserAgentFill sets the User-Agent of the proxy only when the client sent none.
+	UserAgentFill = "fill"
+)
+
+// applyUserAgent applies the User-Agent policy with the User-Agent of the proxy to the
+// request header. Nothing changes when the proxy has no User-Agent.
+func applyUserAgent(policy string, proxy *Proxy, header http.Header) {
+	if proxy == nil || proxy.UserAgent == "" {
+		return
+	}
+	switch policy {
+	case UserAgentOverwrite:
+		header.Set("User-Agent", proxy.UserAgent)
+	case UserAgentFill:
+		if header.Get("User-Agent") == "" {
+			header.Set("User-Agent", proxy.UserAgent)
+		}
+	}
+}
+
+// UserAgentMiddleware applies the User-Agent policy of the project.
+type UserAgentMiddleware struct{}
+
+func (UserAgentMiddleware) HandleRequest(ex *Exchange) *ProxyError {
+	applyUserAgent(ex.Project.UserAgentPolicy, ex.Proxy, ex.Request.Header)
+	return nil
+}
+
+func (UserAgentMiddleware) HandleResponse(*Exchange) *ProxyError {
+	return nil
+}
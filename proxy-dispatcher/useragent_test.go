@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func Test_applyUserAgent(t *testing.T) {
+	proxy := &Proxy{UserAgent: "proxy"}
+	tests := []struct {
+		policy string
+		proxy  *Proxy
+		client string
+		want   string
+	}{
+		{UserAgentKeep, proxy, "client", "client"},
+		{"", proxy, "", ""},
+		{UserAgentOverwrite, proxy, "client", "proxy"},
+		{UserAgentOverwrite, &Proxy{}, "client", "client"},
+		{UserAgentFill, proxy, "client", "client"},
+		{UserAgentFill, proxy, "", "proxy"},
+		{UserAgentFill, nil, "", ""},
+	}
+	for _, tt := range tests {
+		header := make(http.Header)
+		if tt.client != "" {
+			header.Set("User-Agent", tt.client)
+		}
+		applyUserAgent(tt.policy, tt.proxy, header)
+		if got := header.Get("User-Agent"); got != tt.want {
+			t.Errorf("applyUserAgent(%q) with %q = %q, want %q", tt.policy, tt.client, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// certificateReloadDelay groups the events of a file being rewritten into one reload.
+const certificateReloadDelay = 500 * time.Millisecond
+
+// CertificateStore holds the certificate the proxy serves and the CA pool its clients are
+// verified with, both read from the certificate files. A reload swaps them atomically:
+// the new handshakes use the new ones, the connections already open are not affected.
+type CertificateStore struct {
+	certFile       string
+	keyFile        string
+	revocationFile string
+	identities     []string
+	cert           atomic.Pointer[tls.Certificate]
+	pool           atomic.Pointer[x509.CertPool]
+	revoked        atomic.Pointer[map[string]bool]
+}
+
+// CertificateError is returned by the handshake when the client certificate is rejected.
+// Reason is one of "invalid", "untrusted", "revoked" or "identity".
+type CertificateError struct {
+	Reason string
+	Err    error
+}
+
+func (e *CertificateError) Error() string {
+	return fmt.Sprintf("client certificate %s: %s", e.Reason, e.Err)
+}
+
+func (e *CertificateError) Unwrap() error {
+	return e.Err
+}
+
+// NewCertificateStore loads the certificate files. revocationFile, when set, lists the
+// revoked client certificates, as a CRL or as serial numbers in hexadecimal, one per line.
+// identities, when set, are the names one of which the client certificate must hold, in
+// its DNS or URI SANs or as its common name.
+func NewCertificateStore(certFile, keyFile, revocationFile string, identities []string) (*CertificateStore, error) {
+	s := &CertificateStore{certFile: certFile, keyFile: keyFile, revocationFile: revocationFile, identities: identities}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the certificate files again. The current certificate is kept when the
+// files cannot be loaded.
+func (s *CertificateStore) Reload() error {
+	caCert, err := os.ReadFile(s.certFile)
+	if err != nil {
+		return fmt.Errorf("could not read cert file %s: %w", s.certFile, err)
+	}
+	caCertPool := x509.NewCertPool()
+	if !caCertPool.AppendCertsFromPEM(caCert) {
+		return fmt.Errorf("no certificate found in %s", s.certFile)
+	}
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load key pair: %w", err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("could not parse certificate: %w", err)
+		}
+	}
+
+	revoked := make(map[string]bool)
+	if s.revocationFile != "" {
+		if revoked, err = loadRevocationList(s.revocationFile, cert.Leaf); err != nil {
+			return err
+		}
+	}
+
+	s.cert.Store(&cert)
+	s.pool.Store(caCertPool)
+	s.revoked.Store(&revoked)
+	return nil
+}
+
+// loadRevocationList returns the revoked serial numbers, in lowercase hexadecimal. A CRL
+// must be signed by the CA of the proxy.
+func loadRevocationList(file string, ca *x509.Certificate) (map[string]bool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read revocation list %s: %w", file, err)
+	}
+	revoked := make(map[string]bool)
+
+	der := data
+	if block, _ := pem.Decode(data); block != nil && block.Type == "X509 CRL" {
+		der = block.Bytes
+	}
+	if crl, err := x509.ParseRevocationList(der); err == nil {
+		if err = crl.CheckSignatureFrom(ca); err != nil {
+			return nil, fmt.Errorf("invalid revocation list signature: %w", err)
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			revoked[entry.SerialNumber.Text(16)] = true
+		}
+		return revoked, nil
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(strings.ReplaceAll(line, ":", ""), 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid serial number %q in %s", line, file)
+		}
+		revoked[serial.Text(16)] = true
+	}
+	return revoked, nil
+}
+
+// VerifyPeerCertificate verifies the client certificate during the handshake, for
+// tls.Config.VerifyPeerCertificate. The chain is built up to the current CA pool with the
+// intermediates the client sent.
+func (s *CertificateStore) VerifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return &CertificateError{Reason: "invalid", Err: errors.New("no certificate")}
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return &CertificateError{Reason: "invalid", Err: err}
+		}
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	// The dispatcher presents the certificate of the proxy as its client certificate, which
+	// may hold the server authentication usage only.
+	chains, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         s.CertPool(),
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		return &CertificateError{Reason: "untrusted", Err: err}
+	}
+
+	revoked := *s.revoked.Load()
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if revoked[cert.SerialNumber.Text(16)] {
+				return &CertificateError{Reason: "revoked", Err: fmt.Errorf("serial %s is revoked", cert.SerialNumber.Text(16))}
+			}
+		}
+	}
+
+	if len(s.identities) > 0 && !hasIdentity(certs[0], s.identities) {
+		return &CertificateError{Reason: "identity", Err: fmt.Errorf("certificate is not issued for %s", strings.Join(s.identities, ", "))}
+	}
+	return nil
+}
+
+func hasIdentity(cert *x509.Certificate, identities []string) bool {
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	for _, name := range names {
+		if name != "" && slices.Contains(identities, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCertificate returns the current certificate, for tls.Config.GetCertificate.
+func (s *CertificateStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.cert.Load(), nil
+}
+
+// CertPool returns the current CA pool.
+func (s *CertificateStore) CertPool() *x509.CertPool {
+	return s.pool.Load()
+}
+
+// NotAfter returns when the current certificate expires.
+func (s *CertificateStore) NotAfter() time.Time {
+	return s.cert.Load().Leaf.NotAfter
+}
+
+// Watch reloads the certificate whenever its files change, until ctx is done. The
+// directories are watched rather than the files, so that files replaced by a rename or a
+// symlink swap, as Kubernetes does for secrets, are picked up too.
+func (s *CertificateStore) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	dirs := map[string]bool{filepath.Dir(s.certFile): true, filepath.Dir(s.keyFile): true}
+	if s.revocationFile != "" {
+		dirs[filepath.Dir(s.revocationFile)] = true
+	}
+	for dir := range dirs {
+		if err = watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+		var reload <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				reload = time.After(certificateReloadDelay)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Error watching certificate files: %s\n", err)
+			case <-reload:
+				reload = nil
+				s.reloadAndLog()
+			}
+		}
+	}()
+	return nil
+}
+
+// reloadAndLog reloads the certificate and the revocation list, and reports the outcome.
+func (s *CertificateStore) reloadAndLog() {
+	previous := s.cert.Load()
+	if err := s.Reload(); err != nil {
+		certificateReloadCounter.WithLabelValues("failure").Inc()
+		log.Printf("Could not reload certificate, keeping the current one: %s\n", err)
+		return
+	}
+	certificateReloadCounter.WithLabelValues("success").Inc()
+	if current := s.cert.Load(); !current.Leaf.Equal(previous.Leaf) {
+		log.Printf("Reloaded certificate, expires on %s\n", current.Leaf.NotAfter)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testMetrics sync.Once
+
+// initTestMetrics creates the metrics that main registers.
+func initTestMetrics() {
+	testMetrics.Do(func() {
+		activeTunnelsGauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: "active_tunnels"})
+		handshakeCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "handshakes_count"}, []string{"result"})
+		handshakeFailureCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "handshake_failures"}, []string{"reason"})
+		certVerifyFailureCounter = prometheus.NewCounter(prometheus.CounterOpts{Name: "cert_verify_failures"})
+		upstreamDialErrorCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "upstream_dial_errors"}, []string{"class"})
+		upstreamDialHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "upstream_dial_seconds"})
+		bytesReceivedCounter = prometheus.NewCounter(prometheus.CounterOpts{Name: "bytes_received"})
+		bytesSentCounter = prometheus.NewCounter(prometheus.CounterOpts{Name: "bytes_sent"})
+		certificateReloadCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "certificate_reloads"}, []string{"result"})
+	})
+}
+
+// testCA is a self-signed certificate authority, as the certificate of the proxy is.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	cert, key := issue(t, nil, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	})
+	return &testCA{cert: cert, key: key}
+}
+
+// issue creates a certificate from template, signed by ca or self-signed when ca is nil.
+func issue(t *testing.T, ca *testCA, template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parent, parentKey := template, key
+	if ca != nil {
+		parent, parentKey = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// write writes the certificate and the key of the CA to the files the store reads.
+func (ca *testCA) write(t *testing.T, certFile, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertificateStore_VerifyPeerCertificate(t *testing.T) {
+	ca := newTestCA(t, "scrapoxy")
+	otherCA := newTestCA(t, "other")
+	dir := t.TempDir()
+	certFile, keyFile, revocationFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "cert.key"), filepath.Join(dir, "revoked.txt")
+	ca.write(t, certFile, keyFile)
+	if err := os.WriteFile(revocationFile, []byte("# revoked\n0b:ad\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewCertificateStore(certFile, keyFile, revocationFile, []string{"dispatcher", "spiffe://scrapoxy/dispatcher"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := func(ca *testCA, serial int64, name string, usages ...x509.ExtKeyUsage) *x509.Certificate {
+		cert, _ := issue(t, ca, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			ExtKeyUsage:  usages,
+		})
+		return cert
+	}
+	intermediate, intermediateKey := issue(t, ca, &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "intermediate"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	intermediateCA := &testCA{cert: intermediate, key: intermediateKey}
+	spiffe, _ := url.Parse("spiffe://scrapoxy/dispatcher")
+	uriClient, _ := issue(t, ca, &x509.Certificate{
+		SerialNumber: big.NewInt(20),
+		URIs:         []*url.URL{spiffe},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	tests := []struct {
+		name   string
+		certs  []*x509.Certificate
+		reason string
+	}{
+		{name: "client usage", certs: []*x509.Certificate{client(ca, 10, "dispatcher", x509.ExtKeyUsageClientAuth)}},
+		{name: "server usage", certs: []*x509.Certificate{client(ca, 11, "dispatcher", x509.ExtKeyUsageServerAuth)}},
+		{name: "no usage", certs: []*x509.Certificate{client(ca, 12, "dispatcher")}},
+		{name: "uri identity", certs: []*x509.Certificate{uriClient}},
+		{name: "intermediate", certs: []*x509.Certificate{client(intermediateCA, 13, "dispatcher", x509.ExtKeyUsageClientAuth), intermediate}},
+		{name: "missing intermediate", certs: []*x509.Certificate{client(intermediateCA, 14, "dispatcher", x509.ExtKeyUsageClientAuth)}, reason: "untrusted"},
+		{name: "code signing usage", certs: []*x509.Certificate{client(ca, 15, "dispatcher", x509.ExtKeyUsageCodeSigning)}, reason: "untrusted"},
+		{name: "wrong CA", certs: []*x509.Certificate{client(otherCA, 16, "dispatcher", x509.ExtKeyUsageClientAuth)}, reason: "untrusted"},
+		{name: "revoked", certs: []*x509.Certificate{client(ca, 0xbad, "dispatcher", x509.ExtKeyUsageClientAuth)}, reason: "revoked"},
+		{name: "wrong identity", certs: []*x509.Certificate{client(ca, 17, "someone", x509.ExtKeyUsageClientAuth)}, reason: "identity"},
+		{name: "no certificate", reason: "invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rawCerts [][]byte
+			for _, cert := range tt.certs {
+				rawCerts = append(rawCerts, cert.Raw)
+			}
+			err := store.VerifyPeerCertificate(rawCerts, nil)
+			var certErr *CertificateError
+			switch {
+			case tt.reason == "" && err != nil:
+				t.Errorf("VerifyPeerCertificate() = %v, want nil", err)
+			case tt.reason != "" && (!errors.As(err, &certErr) || certErr.Reason != tt.reason):
+				t.Errorf("VerifyPeerCertificate() = %v, want a %s CertificateError", err, tt.reason)
+			}
+		})
+	}
+}
+
+func TestCertificateStore_Reload(t *testing.T) {
+	initTestMetrics()
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "cert.key")
+	first, second := newTestCA(t, "first"), newTestCA(t, "second")
+	first.write(t, certFile, keyFile)
+	store, err := NewCertificateStore(certFile, keyFile, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondClient, _ := issue(t, second, &x509.Certificate{SerialNumber: big.NewInt(10), ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+
+	second.write(t, certFile, keyFile)
+	store.reloadAndLog()
+	if cert, _ := store.GetCertificate(nil); !cert.Leaf.Equal(second.cert) {
+		t.Errorf("GetCertificate() = %s, want %s", cert.Leaf.Subject, second.cert.Subject)
+	}
+	if err = store.VerifyPeerCertificate([][]byte{secondClient.Raw}, nil); err != nil {
+		t.Errorf("VerifyPeerCertificate() = %v, want nil", err)
+	}
+
+	// A broken file keeps the current certificate.
+	if err = os.WriteFile(certFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store.reloadAndLog()
+	if cert, _ := store.GetCertificate(nil); !cert.Leaf.Equal(second.cert) {
+		t.Errorf("GetCertificate() = %s, want %s", cert.Leaf.Subject, second.cert.Subject)
+	}
+}
+
+func TestCertificateStore_Watch(t *testing.T) {
+	initTestMetrics()
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "cert.key")
+	first, second := newTestCA(t, "first"), newTestCA(t, "second")
+	first.write(t, certFile, keyFile)
+	store, err := NewCertificateStore(certFile, keyFile, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err = store.Watch(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	second.write(t, certFile, keyFile)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cert, _ := store.GetCertificate(nil)
+		if cert.Leaf.Equal(second.cert) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("GetCertificate() = %s, want %s", cert.Leaf.Subject, second.cert.Subject)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
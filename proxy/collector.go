@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"proxy/collector"
+)
+
+type Collector struct {
+	certificates *CertificateStore
+	metrics      map[string]collector.MetricInfo
+}
+
+func NewCollector(certificates *CertificateStore, namespace, subsystem string) Collector {
+	return Collector{
+		certificates: certificates,
+		metrics: map[string]collector.MetricInfo{
+			"active_tunnels":        collector.NewMetric(namespace, subsystem, "active_tunnels", "", prometheus.GaugeValue, nil, []string{}),
+			"handshakes_count":      collector.NewMetric(namespace, subsystem, "handshakes_count", "", prometheus.CounterValue, nil, []string{"result"}),
+			"handshake_failures":    collector.NewMetric(namespace, subsystem, "handshake_failures", "", prometheus.CounterValue, nil, []string{"reason"}),
+			"cert_verify_failures":  collector.NewMetric(namespace, subsystem, "cert_verify_failures", "", prometheus.CounterValue, nil, []string{}),
+			"upstream_dial_errors":  collector.NewMetric(namespace, subsystem, "upstream_dial_errors", "", prometheus.CounterValue, nil, []string{"class"}),
+			"upstream_dial_seconds": collector.NewMetric(namespace, subsystem, "upstream_dial_seconds", "", prometheus.UntypedValue, nil, []string{}),
+			"bytes_received":        collector.NewMetric(namespace, subsystem, "bytes_received", "", prometheus.CounterValue, nil, []string{}),
+			"bytes_sent":            collector.NewMetric(namespace, subsystem, "bytes_sent", "", prometheus.CounterValue, nil, []string{}),
+			"certificate_expiry":    collector.NewMetric(namespace, subsystem, "certificate_expiry", "", prometheus.GaugeValue, nil, []string{}),
+			"certificate_reloads":   collector.NewMetric(namespace, subsystem, "certificate_reloads", "", prometheus.CounterValue, nil, []string{"result"}),
+		},
+	}
+}
+
+func (c Collector) GetMetrics() map[string]collector.MetricInfo {
+	return c.metrics
+}
+
+func (c Collector) CollectStats() map[string]map[string]collector.MetricValue {
+	stats := make(map[string]map[string]collector.MetricValue)
+	stats["active_tunnels"] = map[string]collector.MetricValue{"default": collector.MetricValue{Collector: activeTunnelsGauge.Collect}}
+	stats["handshakes_count"] = map[string]collector.MetricValue{"default": collector.MetricValue{Collector: handshakeCounter.Collect}}
+	stats["handshake_failures"] = map[string]collector.MetricValue{"default": collector.MetricValue{Collector: handshakeFailureCounter.Collect}}
+	stats["cert_verify_failures"] = map[string]collector.MetricValue{"default": collector.MetricValue{Collector: certVerifyFailureCounter.Collect}}
+	stats["upstream_dial_errors"] = map[string]collector.MetricValue{"default": collector.MetricValue{Collector: upstreamDialErrorCounter.Collect}}
+	stats["upstream_dial_seconds"] = map[string]collector.MetricValue{"default": collector.MetricValue{Collector: upstreamDialHistogram.Collect}}
+
+	stats["bytes_received"] = map[string]collector.MetricValue{"default": collector.MetricValue{Collector: bytesReceivedCounter.Collect}}
+	stats["bytes_sent"] = map[string]collector.MetricValue{"default": collector.MetricValue{Collector: bytesSentCounter.Collect}}
+
+	stats["certificate_expiry"] = map[string]collector.MetricValue{"default": collector.MetricValue{Value: c.certificates.NotAfter().Unix()}}
+	stats["certificate_reloads"] = map[string]collector.MetricValue{"default": collector.MetricValue{Collector: certificateReloadCounter.Collect}}
+	return stats
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"path/filepath"
+	"proxy/collector"
+	"strings"
+	"testing"
+)
+
+func TestCollector_CollectStats(t *testing.T) {
+	initTestMetrics()
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "cert.key")
+	ca := newTestCA(t, "proxy")
+	ca.write(t, certFile, keyFile)
+	store, err := NewCertificateStore(certFile, keyFile, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The metrics are named as main names them, the collector reports them under these names.
+	active, handshakes, handshakeFailures, verifyFailures, dialErrors, dial, received, sent, reloads := activeTunnelsGauge, handshakeCounter, handshakeFailureCounter, certVerifyFailureCounter, upstreamDialErrorCounter, upstreamDialHistogram, bytesReceivedCounter, bytesSentCounter, certificateReloadCounter
+	t.Cleanup(func() {
+		activeTunnelsGauge, handshakeCounter, handshakeFailureCounter, certVerifyFailureCounter, upstreamDialErrorCounter, upstreamDialHistogram, bytesReceivedCounter, bytesSentCounter, certificateReloadCounter = active, handshakes, handshakeFailures, verifyFailures, dialErrors, dial, received, sent, reloads
+	})
+	activeTunnelsGauge = prometheus.NewGauge(prometheus.GaugeOpts{Namespace: "scrapoxy", Subsystem: "proxy", Name: "active_tunnels"})
+	handshakeCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: "scrapoxy", Subsystem: "proxy", Name: "handshakes_count"}, []string{"result"})
+	handshakeFailureCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: "scrapoxy", Subsystem: "proxy", Name: "handshake_failures"}, []string{"reason"})
+	certVerifyFailureCounter = prometheus.NewCounter(prometheus.CounterOpts{Namespace: "scrapoxy", Subsystem: "proxy", Name: "cert_verify_failures"})
+	upstreamDialErrorCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: "scrapoxy", Subsystem: "proxy", Name: "upstream_dial_errors"}, []string{"class"})
+	upstreamDialHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{Namespace: "scrapoxy", Subsystem: "proxy", Name: "upstream_dial_seconds"})
+	bytesReceivedCounter = prometheus.NewCounter(prometheus.CounterOpts{Namespace: "scrapoxy", Subsystem: "proxy", Name: "bytes_received"})
+	bytesSentCounter = prometheus.NewCounter(prometheus.CounterOpts{Namespace: "scrapoxy", Subsystem: "proxy", Name: "bytes_sent"})
+	certificateReloadCounter = prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: "scrapoxy", Subsystem: "proxy", Name: "certificate_reloads"}, []string{"result"})
+
+	activeTunnelsGauge.Set(2)
+	handshakeCounter.WithLabelValues("accepted").Add(3)
+	handshakeCounter.WithLabelValues("rejected").Inc()
+	certVerifyFailureCounter.Inc()
+	upstreamDialErrorCounter.WithLabelValues("timeout").Inc()
+	bytesReceivedCounter.Add(100)
+	bytesSentCounter.Add(50)
+
+	metrics := collector.NewPrometheusMetrics(collector.Collector{Namespace: "scrapoxy", Subsystem: "proxy"}, NewCollector(store, "scrapoxy", "proxy"))
+	expected := fmt.Sprintf(`
+# HELP scrapoxy_proxy_active_tunnels 
+# TYPE scrapoxy_proxy_active_tunnels gauge
+scrapoxy_proxy_active_tunnels 2
+# HELP scrapoxy_proxy_handshakes_count 
+# TYPE scrapoxy_proxy_handshakes_count counter
+scrapoxy_proxy_handshakes_count{result="accepted"} 3
+scrapoxy_proxy_handshakes_count{result="rejected"} 1
+# HELP scrapoxy_proxy_cert_verify_failures 
+# TYPE scrapoxy_proxy_cert_verify_failures counter
+scrapoxy_proxy_cert_verify_failures 1
+# HELP scrapoxy_proxy_upstream_dial_errors 
+# TYPE scrapoxy_proxy_upstream_dial_errors counter
+scrapoxy_proxy_upstream_dial_errors{class="timeout"} 1
+# HELP scrapoxy_proxy_bytes_received 
+# TYPE scrapoxy_proxy_bytes_received counter
+scrapoxy_proxy_bytes_received 100
+# HELP scrapoxy_proxy_bytes_sent 
+# TYPE scrapoxy_proxy_bytes_sent counter
+scrapoxy_proxy_bytes_sent 50
+# HELP scrapoxy_proxy_certificate_expiry 
+# TYPE scrapoxy_proxy_certificate_expiry gauge
+scrapoxy_proxy_certificate_expiry %d
+`, ca.cert.NotAfter.Unix())
+	names := []string{
+		"scrapoxy_proxy_active_tunnels",
+		"scrapoxy_proxy_handshakes_count",
+		"scrapoxy_proxy_cert_verify_failures",
+		"scrapoxy_proxy_upstream_dial_errors",
+		"scrapoxy_proxy_bytes_received",
+		"scrapoxy_proxy_bytes_sent",
+		"scrapoxy_proxy_certificate_expiry",
+	}
+	if err = testutil.CollectAndCompare(metrics, strings.NewReader(expected), names...); err != nil {
+		t.Error(err)
+	}
+	if count := testutil.CollectAndCount(metrics, "scrapoxy_proxy_upstream_dial_seconds"); count != 1 {
+		t.Errorf("upstream_dial_seconds series = %d, want 1", count)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"proxy/utils"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The address families a Dialer can be restricted to or prefer.
+const (
+	FamilyAny        = "any"
+	FamilyIPv4       = "ipv4"
+	FamilyIPv6       = "ipv6"
+	FamilyPreferIPv4 = "prefer-ipv4"
+	FamilyPreferIPv6 = "prefer-ipv6"
+)
+
+// sourceAddressHeader lets the client of a CONNECT pick the local address of the tunnel
+// among the source addresses of the proxy.
+const sourceAddressHeader = "X-Scrapoxy-Source-Address"
+
+// maxResolverCacheEntries bounds the DNS cache, the expired entries are dropped past it.
+const maxResolverCacheEntries = 10000
+
+type DialerConfig struct {
+	// Timeout bounds the whole dial, DNS resolution included. 0 disables it.
+	Timeout time.Duration
+	// Family is one of the Family constants. With FamilyAny, the family of the first
+	// address the resolver returns is preferred.
+	Family string
+	// FallbackDelay is how long the addresses of the preferred family are tried alone
+	// before the other family races them (Happy Eyeballs, RFC 8305). A negative delay
+	// tries all the addresses one after the other.
+	FallbackDelay time.Duration
+	// Resolver is the host:port of the DNS server, the system resolver is used when empty.
+	Resolver string
+	// CacheTTL is how long the resolved addresses are kept. 0 disables the cache.
+	CacheTTL time.Duration
+	// SourceAddrs are the local addresses the connections can be bound to. The first one
+	// of the family of the target is used by default. When there are some, the targets of
+	// a family without a source address are not dialed.
+	SourceAddrs []netip.Addr
+}
+
+// resolver resolves the targets, a *net.Resolver.
+type resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+type resolvedHost struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// Dialer connects the proxy to the targets. The policy checks every address it dials,
+// after the DNS resolution.
+type Dialer struct {
+	config   DialerConfig
+	policy   *utils.Policy
+	resolver resolver
+	mutex    sync.Mutex
+	cache    map[string]resolvedHost
+}
+
+func NewDialer(config DialerConfig, policy *utils.Policy) (*Dialer, error) {
+	switch config.Family {
+	case "":
+		config.Family = FamilyAny
+	case FamilyAny, FamilyIPv4, FamilyIPv6, FamilyPreferIPv4, FamilyPreferIPv6:
+	default:
+		return nil, fmt.Errorf("invalid address family %q", config.Family)
+	}
+
+	var r resolver = net.DefaultResolver
+	if config.Resolver != "" {
+		server := config.Resolver
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		r = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return &Dialer{
+		config:   config,
+		policy:   policy,
+		resolver: r,
+		cache:    make(map[string]resolvedHost),
+	}, nil
+}
+
+// ParseAddrs parses a comma separated list of IP addresses.
+func ParseAddrs(s string) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	for _, item := range utils.SplitList(s) {
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q", item)
+		}
+		addrs = append(addrs, addr.Unmap())
+	}
+	return addrs, nil
+}
+
+// Source returns the source address a client asked for, which must be one of the source
+// addresses of the dialer. It returns the zero address when s is empty.
+func (d *Dialer) Source(s string) (netip.Addr, error) {
+	if s == "" {
+		return netip.Addr{}, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid source address %q", s)
+	}
+	if addr = addr.Unmap(); !slices.Contains(d.config.SourceAddrs, addr) {
+		return netip.Addr{}, fmt.Errorf("source address %s is not available", addr)
+	}
+	return addr, nil
+}
+
+// DialContext dials address from the default source address, for http.Transport.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.Dial(ctx, address, netip.Addr{})
+}
+
+// Dial connects to the host:port address and records the outcome in the metrics. When
+// source is valid, the connection is bound to it and only the addresses of its family are
+// dialed.
+func (d *Dialer) Dial(ctx context.Context, address string, source netip.Addr) (net.Conn, error) {
+	start := time.Now()
+	conn, err := d.dial(ctx, address, source)
+	upstreamDialHistogram.Observe(time.Since(start).Seconds())
+	if err != nil {
+		upstreamDialErrorCounter.WithLabelValues(dialErrorClass(err)).Inc()
+	}
+	return conn, err
+}
+
+func (d *Dialer) dial(ctx context.Context, address string, source netip.Addr) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %s", address)
+	}
+	if d.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.config.Timeout)
+		defer cancel()
+	}
+
+	addrs, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	primaries, fallbacks := d.partition(addrs, source)
+	if len(primaries) == 0 {
+		return nil, &net.DNSError{Err: "no usable address", Name: host, IsNotFound: true}
+	}
+	targets := func(addrs []netip.Addr) []netip.AddrPort {
+		var ports []netip.AddrPort
+		for _, addr := range addrs {
+			ports = append(ports, netip.AddrPortFrom(addr, uint16(port)))
+		}
+		return ports
+	}
+
+	if len(fallbacks) == 0 || d.config.FallbackDelay < 0 {
+		return d.dialSerial(ctx, targets(append(primaries, fallbacks...)), source)
+	}
+	return d.dialParallel(ctx, targets(primaries), targets(fallbacks), source)
+}
+
+// lookup resolves host, from the cache when it holds it.
+func (d *Dialer) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+	if d.config.CacheTTL > 0 {
+		d.mutex.Lock()
+		entry, ok := d.cache[host]
+		d.mutex.Unlock()
+		if ok && time.Now().Before(entry.expires) {
+			return entry.addrs, nil
+		}
+	}
+
+	addrs, err := d.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	for i := range addrs {
+		addrs[i] = addrs[i].Unmap()
+	}
+
+	if d.config.CacheTTL > 0 {
+		now := time.Now()
+		d.mutex.Lock()
+		if len(d.cache) >= maxResolverCacheEntries {
+			for name, entry := range d.cache {
+				if now.After(entry.expires) {
+					delete(d.cache, name)
+				}
+			}
+			if len(d.cache) >= maxResolverCacheEntries {
+				clear(d.cache)
+			}
+		}
+		d.cache[host] = resolvedHost{addrs: addrs, expires: now.Add(d.config.CacheTTL)}
+		d.mutex.Unlock()
+	}
+	return addrs, nil
+}
+
+// partition splits the addresses between the preferred family and the other one,
+// leaving out the addresses the family restriction or the source addresses exclude.
+func (d *Dialer) partition(addrs []netip.Addr, source netip.Addr) (primaries, fallbacks []netip.Addr) {
+	var usable []netip.Addr
+	for _, addr := range addrs {
+		switch {
+		case d.config.Family == FamilyIPv4 && !addr.Is4(), d.config.Family == FamilyIPv6 && addr.Is4():
+		case !d.sourceFor(addr, source).IsValid() && (source.IsValid() || len(d.config.SourceAddrs) > 0):
+		default:
+			usable = append(usable, addr)
+		}
+	}
+	if len(usable) == 0 {
+		return nil, nil
+	}
+
+	preferIPv4 := usable[0].Is4()
+	switch d.config.Family {
+	case FamilyIPv4, FamilyPreferIPv4:
+		preferIPv4 = true
+	case FamilyIPv6, FamilyPreferIPv6:
+		preferIPv4 = false
+	}
+	for _, addr := range usable {
+		if addr.Is4() == preferIPv4 {
+			primaries = append(primaries, addr)
+		} else {
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+	if len(primaries) == 0 {
+		return fallbacks, nil
+	}
+	return primaries, fallbacks
+}
+
+// sourceFor returns the local address to dial addr from, the zero address when the
+// connection is not bound or when no source address has the family of addr.
+func (d *Dialer) sourceFor(addr, source netip.Addr) netip.Addr {
+	if source.IsValid() {
+		if source.Is4() != addr.Is4() {
+			return netip.Addr{}
+		}
+		return source
+	}
+	for _, s := range d.config.SourceAddrs {
+		if s.Is4() == addr.Is4() {
+			return s
+		}
+	}
+	return netip.Addr{}
+}
+
+// dialSerial tries the targets one after the other and returns the first connection, or
+// the first error when they all fail.
+func (d *Dialer) dialSerial(ctx context.Context, targets []netip.AddrPort, source netip.Addr) (net.Conn, error) {
+	var firstErr error
+	for _, target := range targets {
+		dialer := &net.Dialer{Control: d.policy.Control}
+		if local := d.sourceFor(target.Addr(), source); local.IsValid() {
+			dialer.LocalAddr = &net.TCPAddr{IP: local.AsSlice()}
+		}
+		conn, err := dialer.DialContext(ctx, "tcp", target.String())
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// dialParallel races the fallbacks against the primaries once the primaries had
+// FallbackDelay alone, or as soon as they all failed. The first connection wins.
+func (d *Dialer) dialParallel(ctx context.Context, primaries, fallbacks []netip.AddrPort, source netip.Addr) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 2)
+	start := func(targets []netip.AddrPort) {
+		go func() {
+			conn, err := d.dialSerial(ctx, targets, source)
+			results <- result{conn, err}
+		}()
+	}
+
+	start(primaries)
+	pending := 1
+	fallbackStarted := false
+	timer := time.NewTimer(d.config.FallbackDelay)
+	defer timer.Stop()
+
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				start(fallbacks)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if pending > 0 {
+					// The loser is cancelled, it may still have connected meanwhile.
+					go func() {
+						if res := <-results; res.conn != nil {
+							res.conn.Close()
+						}
+					}()
+				}
+				return res.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				start(fallbacks)
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
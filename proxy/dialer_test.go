@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"proxy/utils"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeResolver resolves the hosts it holds and counts the lookups.
+type fakeResolver struct {
+	mutex   sync.Mutex
+	hosts   map[string][]netip.Addr
+	lookups int
+}
+
+func (r *fakeResolver) LookupNetIP(_ context.Context, _, host string) ([]netip.Addr, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.lookups++
+	addrs, ok := r.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return slices.Clone(addrs), nil
+}
+
+func newTestDialer(t *testing.T, config DialerConfig, hosts map[string][]netip.Addr) (*Dialer, *fakeResolver) {
+	t.Helper()
+	initTestMetrics()
+	policy, err := utils.NewPolicy(utils.PolicyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDialer(config, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeResolver{hosts: hosts}
+	d.resolver = r
+	return d, r
+}
+
+// listen listens on address, and accepts the connections until the end of the test.
+func listen(t *testing.T, address string) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Skipf("cannot listen on %s: %s", address, err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return l
+}
+
+// listenBlackhole returns the port of a listener on 127.0.0.1 which never completes the
+// connections: its accept queue is full.
+func listenBlackhole(t *testing.T) int {
+	t.Helper()
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+	if err = syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := sa.(*syscall.SockaddrInet4).Port
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return port
+}
+
+func TestDialer_partition(t *testing.T) {
+	v4a, v4b := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	v6a, v6b := netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("2001:db8::2")
+	mixed := []netip.Addr{v6a, v4a, v6b, v4b}
+
+	tests := []struct {
+		name      string
+		config    DialerConfig
+		source    netip.Addr
+		addrs     []netip.Addr
+		primaries []netip.Addr
+		fallbacks []netip.Addr
+	}{
+		{name: "any prefers the first family", config: DialerConfig{Family: FamilyAny}, addrs: mixed, primaries: []netip.Addr{v6a, v6b}, fallbacks: []netip.Addr{v4a, v4b}},
+		{name: "prefer ipv4", config: DialerConfig{Family: FamilyPreferIPv4}, addrs: mixed, primaries: []netip.Addr{v4a, v4b}, fallbacks: []netip.Addr{v6a, v6b}},
+		{name: "prefer ipv4 without ipv4", config: DialerConfig{Family: FamilyPreferIPv4}, addrs: []netip.Addr{v6a, v6b}, primaries: []netip.Addr{v6a, v6b}},
+		{name: "ipv6 only", config: DialerConfig{Family: FamilyIPv6}, addrs: mixed, primaries: []netip.Addr{v6a, v6b}},
+		{name: "ipv4 only without ipv4", config: DialerConfig{Family: FamilyIPv4}, addrs: []netip.Addr{v6a}},
+		{name: "source addresses", config: DialerConfig{Family: FamilyAny, SourceAddrs: []netip.Addr{netip.MustParseAddr("198.51.100.1")}}, addrs: mixed, primaries: []netip.Addr{v4a, v4b}},
+		{name: "bound source", config: DialerConfig{Family: FamilyAny}, source: netip.MustParseAddr("2001:db8::10"), addrs: mixed, primaries: []netip.Addr{v6a, v6b}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := newTestDialer(t, tt.config, nil)
+			primaries, fallbacks := d.partition(tt.addrs, tt.source)
+			if !slices.Equal(primaries, tt.primaries) || !slices.Equal(fallbacks, tt.fallbacks) {
+				t.Errorf("partition() = %v, %v, want %v, %v", primaries, fallbacks, tt.primaries, tt.fallbacks)
+			}
+		})
+	}
+}
+
+func TestDialer_Dial_fallback(t *testing.T) {
+	blackhole := listenBlackhole(t)
+	listen(t, fmt.Sprintf("[::1]:%d", blackhole))
+	refused := listen(t, "[::1]:0").Addr().(*net.TCPAddr).Port
+
+	hosts := map[string][]netip.Addr{"dual.test": {netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("::1")}}
+	tests := []struct {
+		name   string
+		config DialerConfig
+		port   int
+		// remote is the address connected to, empty when the dial fails.
+		remote     string
+		minElapsed time.Duration
+		maxElapsed time.Duration
+	}{
+		{
+			name:       "fallback after the delay",
+			config:     DialerConfig{FallbackDelay: 200 * time.Millisecond},
+			port:       blackhole,
+			remote:     "::1",
+			minElapsed: 200 * time.Millisecond,
+			maxElapsed: time.Second,
+		},
+		{
+			name:       "fallback when the primaries failed",
+			config:     DialerConfig{FallbackDelay: 5 * time.Second},
+			port:       refused,
+			remote:     "::1",
+			maxElapsed: time.Second,
+		},
+		{
+			name:       "preferred family",
+			config:     DialerConfig{Family: FamilyPreferIPv6, FallbackDelay: 5 * time.Second},
+			port:       blackhole,
+			remote:     "::1",
+			maxElapsed: time.Second,
+		},
+		{
+			name:       "serial until the timeout",
+			config:     DialerConfig{Timeout: 300 * time.Millisecond, FallbackDelay: -1},
+			port:       blackhole,
+			minElapsed: 300 * time.Millisecond,
+			maxElapsed: 2 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := newTestDialer(t, tt.config, hosts)
+			start := time.Now()
+			conn, err := d.Dial(context.Background(), fmt.Sprintf("dual.test:%d", tt.port), netip.Addr{})
+			elapsed := time.Since(start)
+			if conn != nil {
+				defer conn.Close()
+			}
+
+			switch {
+			case tt.remote == "" && err == nil:
+				t.Errorf("Dial() = %s, want an error", conn.RemoteAddr())
+			case tt.remote != "" && err != nil:
+				t.Errorf("Dial() = %v, want a connection to %s", err, tt.remote)
+			case tt.remote != "" && conn.RemoteAddr().(*net.TCPAddr).IP.String() != tt.remote:
+				t.Errorf("Dial() = %s, want a connection to %s", conn.RemoteAddr(), tt.remote)
+			}
+			if elapsed < tt.minElapsed || elapsed > tt.maxElapsed {
+				t.Errorf("Dial() took %s, want between %s and %s", elapsed, tt.minElapsed, tt.maxElapsed)
+			}
+		})
+	}
+}
+
+func TestDialer_lookup(t *testing.T) {
+	hosts := map[string][]netip.Addr{"cached.test": {netip.MustParseAddr("127.0.0.1")}}
+	d, r := newTestDialer(t, DialerConfig{CacheTTL: 100 * time.Millisecond}, hosts)
+
+	lookup := func(wantLookups int) {
+		t.Helper()
+		addrs, err := d.lookup(context.Background(), "cached.test")
+		if err != nil || !slices.Equal(addrs, hosts["cached.test"]) {
+			t.Errorf("lookup() = %v, %v, want %v", addrs, err, hosts["cached.test"])
+		}
+		if r.lookups != wantLookups {
+			t.Errorf("lookups = %d, want %d", r.lookups, wantLookups)
+		}
+	}
+	lookup(1)
+	lookup(1)
+	time.Sleep(150 * time.Millisecond)
+	lookup(2)
+
+	// The failures are not cached.
+	for i := 0; i < 2; i++ {
+		if _, err := d.lookup(context.Background(), "missing.test"); err == nil {
+			t.Errorf("lookup() = nil, want an error")
+		}
+	}
+	if r.lookups != 4 {
+		t.Errorf("lookups = %d, want 4", r.lookups)
+	}
+}
+
+func TestDialer_Dial_source(t *testing.T) {
+	l := listen(t, "127.0.0.1:0")
+	address := l.Addr().String()
+	_, port, _ := net.SplitHostPort(address)
+
+	tests := []struct {
+		name    string
+		sources []netip.Addr
+		source  string
+		address string
+		// local is the address bound, empty when the dial fails.
+		local string
+	}{
+		{name: "default source", sources: []netip.Addr{netip.MustParseAddr("127.0.0.1")}, address: address, local: "127.0.0.1"},
+		{name: "chosen source", sources: []netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("127.0.0.2")}, source: "127.0.0.2", address: address, local: "127.0.0.2"},
+		{name: "unknown source", sources: []netip.Addr{netip.MustParseAddr("127.0.0.1")}, source: "127.0.0.3", address: address},
+		{name: "invalid source", sources: []netip.Addr{netip.MustParseAddr("127.0.0.1")}, source: "local", address: address},
+		{name: "no source of the family", sources: []netip.Addr{netip.MustParseAddr("::1")}, address: address},
+		{name: "source not on the host", sources: []netip.Addr{netip.MustParseAddr("192.0.2.1")}, address: address},
+		{name: "target of the other family", sources: []netip.Addr{netip.MustParseAddr("127.0.0.1")}, address: net.JoinHostPort("::1", port)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _ := newTestDialer(t, DialerConfig{SourceAddrs: tt.sources}, nil)
+			source, err := d.Source(tt.source)
+			var conn net.Conn
+			if err == nil {
+				conn, err = d.Dial(context.Background(), tt.address, source)
+			}
+			if conn != nil {
+				defer conn.Close()
+			}
+
+			switch {
+			case tt.local == "" && err == nil:
+				t.Errorf("Dial() = %s, want an error", conn.LocalAddr())
+			case tt.local != "" && err != nil:
+				t.Errorf("Dial() = %v, want a connection from %s", err, tt.local)
+			case tt.local != "" && conn.LocalAddr().(*net.TCPAddr).IP.String() != tt.local:
+				t.Errorf("Dial() = %s, want a connection from %s", conn.LocalAddr(), tt.local)
+			}
+		})
+	}
+
+	// A target without a usable address is reported as not found.
+	d, _ := newTestDialer(t, DialerConfig{SourceAddrs: []netip.Addr{netip.MustParseAddr("127.0.0.1")}}, nil)
+	_, err := d.Dial(context.Background(), net.JoinHostPort("::1", port), netip.Addr{})
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("Dial() = %v, want a not found DNSError", err)
+	}
+}
@@ -1,63 +1,298 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
-	"crypto/x509"
+	"errors"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"log"
 	"net"
 	"net/http"
 	"proxy/utils"
+	"slices"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 )
 
+// errHeaderTooLarge is returned by the reader of a connection when the header of a
+// request exceeds the limit.
+var errHeaderTooLarge = errors.New("request header too large")
+
 type Handler struct {
-	caCertPool *x509.CertPool
+	relayOptions utils.RelayOptions
+	transport    *http.Transport
+	policy       *utils.Policy
+	dialer       *Dialer
+	tracker      *utils.ConnTracker
+	// keepAliveTimeout is how long the connection waits for the first byte of a request,
+	// headerTimeout how long the rest of the header may then take.
+	keepAliveTimeout time.Duration
+	headerTimeout    time.Duration
+	maxHeaderBytes   int64
 }
 
-func (h Handler) ServeRequest(req *http.Request, conn net.Conn) {
-	if req != nil && req.Method == "CONNECT" {
-		_, certError := conn.(*tls.Conn).ConnectionState().PeerCertificates[0].Verify(struct {
-			DNSName                   string
-			Intermediates             *x509.CertPool
-			Roots                     *x509.CertPool
-			CurrentTime               time.Time
-			KeyUsages                 []x509.ExtKeyUsage
-			MaxConstraintComparisions int
-		}{Roots: h.caCertPool})
-
-		if certError != nil {
-			fmt.Println("Error verifying certificate")
-			fmt.Println(certError)
-			conn.Write([]byte("HTTP/1.1 401 connect_error\r\nX-Scrapoxy-Proxyerror: invalid certificate\r\n\r\n\r\n"))
+// NewTransport returns the transport used to forward plain HTTP requests. Its idle
+// connections to the targets are shared by all the clients.
+func NewTransport(dialer *Dialer) *http.Transport {
+	return &http.Transport{
+		DialContext:         dialer.DialContext,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+		// The client gets the body as the target sent it.
+		DisableCompression: true,
+	}
+}
+
+// ServeConn serves the requests of the connection until it is closed or turned into a
+// tunnel. The client certificate was verified by the handshake.
+func (h Handler) ServeConn(conn *tls.Conn) {
+	// The reader is kept across the requests, it may hold the start of the next one or the
+	// first bytes the client sent in a tunnel.
+	limiter := &headerLimitReader{r: conn, remaining: -1}
+	reader := bufio.NewReader(limiter)
+	for {
+		// A connection waiting for its first request is normal, the dispatcher keeps some
+		// open in advance, so only the header itself gets the short deadline.
+		conn.SetReadDeadline(deadline(h.keepAliveTimeout))
+		if !h.tracker.SetIdle(conn, true) {
 			return
 		}
-		host := req.Host
-		if len(strings.Split(host, ":")) != 2 {
-			fmt.Println(req.URL)
+		_, err := reader.Peek(1)
+		if !h.tracker.SetIdle(conn, false) || err != nil {
+			return
 		}
-		remoteConn, err := net.DialTimeout("tcp", host, 60*time.Second)
+		conn.SetReadDeadline(deadline(h.headerTimeout))
+		// Like net/http, leave some room for the bytes buffered past the header.
+		limiter.remaining = h.maxHeaderBytes + 4096
+		req, err := http.ReadRequest(reader)
+		limiter.remaining = -1
+		conn.SetReadDeadline(time.Time{})
 		if err != nil {
-			fmt.Println(err)
-			conn.Write([]byte("HTTP/1.1 500 connect_error\r\nX-Scrapoxy-Proxyerror: ${errMessage}\r\n\r\n\r\n"))
+			var netErr net.Error
+			switch {
+			case errors.Is(err, errHeaderTooLarge):
+				writeError(conn, http.StatusRequestHeaderFieldsTooLarge, "header_too_large", "request header too large")
+			case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.As(err, &netErr):
+				// The client went away or was too slow, there is no one to answer.
+			default:
+				writeError(conn, http.StatusBadRequest, "bad_request", "malformed request")
+			}
+			log.Printf("Could not read request from %s: %s\n", conn.RemoteAddr(), err)
+			return
+		}
+		if !h.ServeRequest(req, utils.NewBufferedConn(conn, reader)) {
 			return
 		}
+	}
+}
+
+// headerLimitReader fails the reads past remaining bytes, to bound the size of a request
+// header. A negative remaining disables the limit.
+type headerLimitReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *headerLimitReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return l.r.Read(p)
+	}
+	if l.remaining == 0 {
+		return 0, errHeaderTooLarge
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// deadline returns the deadline of a timeout starting now, none when timeout is 0.
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// ServeRequest opens a tunnel for a CONNECT request, or forwards a request with an
+// absolute URI to its target. It returns whether the connection can serve another request.
+func (h Handler) ServeRequest(req *http.Request, conn net.Conn) bool {
+	if req != nil && req.Method == "CONNECT" {
+		host := req.Host
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			writeError(conn, http.StatusBadRequest, "bad_request", "invalid CONNECT target "+host)
+			return false
+		}
+		if err := h.policy.CheckHost(host); err != nil {
+			writeDenied(conn, err)
+			return false
+		}
+		source, err := h.dialer.Source(req.Header.Get(sourceAddressHeader))
+		if err != nil {
+			writeError(conn, http.StatusBadRequest, "bad_request", err.Error())
+			return false
+		}
+		remoteConn, err := h.dialer.Dial(context.Background(), host, source)
+		if err != nil {
+			var policyErr *utils.PolicyError
+			if errors.As(err, &policyErr) {
+				writeDenied(conn, policyErr)
+				return false
+			}
+			log.Printf("Could not connect to %s: %s\n", host, err)
+			writeError(conn, http.StatusBadGateway, "target_unreachable", strings.ReplaceAll(err.Error(), "\r\n", " "))
+			return false
+		}
 		defer remoteConn.Close()
 
 		conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
 
-		var wg sync.WaitGroup
-		wg.Add(2)
+		activeTunnelsGauge.Inc()
+		defer activeTunnelsGauge.Dec()
 
-		go utils.PipeSocket(conn, remoteConn, &wg)
-		go utils.PipeSocket(remoteConn, conn, &wg)
-
-		wg.Wait()
+		stats := utils.Relay(conn, remoteConn, h.relayOptions)
+		bytesReceivedCounter.Add(float64(stats.Received))
+		bytesSentCounter.Add(float64(stats.Sent))
+		if err := stats.Err(); err != nil {
+			log.Printf("Tunnel to %s closed: %s\n", host, err)
+		}
 
-		return
+		return false
+	} else if req != nil && req.URL.IsAbs() {
+		return h.forward(req, conn)
 	} else {
 		conn.Write([]byte("HTTP/1.1 404 Not Found\n\n"))
-		return
+		return false
+	}
+}
+
+// forward sends a plain HTTP request to its target and writes the response back. It
+// returns whether both sides allow another request on the connection.
+func (h Handler) forward(req *http.Request, conn net.Conn) bool {
+	keepAlive := !req.Close
+	req.RequestURI = ""
+	req.Close = false
+	removeHopByHopHeaders(req.Header)
+	// The transport shares its connections between the clients, they cannot pick a source.
+	req.Header.Del(sourceAddressHeader)
+	if req.Body != nil {
+		req.Body = &countingReadCloser{ReadCloser: req.Body, counter: bytesSentCounter}
+	}
+
+	host := req.URL.Host
+	if req.URL.Port() == "" {
+		port := "80"
+		if req.URL.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(req.URL.Hostname(), port)
+	}
+	if err := h.policy.CheckHost(host); err != nil {
+		writeDenied(conn, err)
+		return false
+	}
+
+	resp, err := h.transport.RoundTrip(req)
+	if err != nil {
+		var policyErr *utils.PolicyError
+		if errors.As(err, &policyErr) {
+			writeDenied(conn, policyErr)
+			return false
+		}
+		log.Printf("Could not forward request to %s: %s\n", req.Host, err)
+		writeError(conn, http.StatusBadGateway, "forward_error", strings.ReplaceAll(err.Error(), "\r\n", " "))
+		return false
+	}
+	defer resp.Body.Close()
+
+	removeHopByHopHeaders(resp.Header)
+	resp.ProtoMajor, resp.ProtoMinor = 1, 1
+	// Without a length or chunked encoding, only closing the connection ends the body.
+	unknownLength := resp.ContentLength == -1 && !slices.Contains(resp.TransferEncoding, "chunked")
+	resp.Close = !keepAlive || unknownLength
+	resp.Body = &countingReadCloser{ReadCloser: resp.Body, counter: bytesReceivedCounter}
+	if err = resp.Write(conn); err != nil {
+		return false
+	}
+	return !resp.Close
+}
+
+// hopByHopHeaders only apply to a single connection and are not forwarded (RFC 9110).
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// countingReadCloser adds the bytes read to counter.
+type countingReadCloser struct {
+	io.ReadCloser
+	counter prometheus.Counter
+}
+
+func (r *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.counter.Add(float64(n))
+	return n, err
+}
+
+// writeDenied answers a request whose target the policy denies.
+func writeDenied(conn net.Conn, err error) {
+	log.Println(err)
+	reason := err.Error()
+	var policyErr *utils.PolicyError
+	if errors.As(err, &policyErr) {
+		reason = policyErr.Reason
+	}
+	writeError(conn, http.StatusForbidden, "target_denied", reason)
+}
+
+// writeError answers a request with an error and no body. The connection is closed after.
+func writeError(conn net.Conn, status int, code, reason string) {
+	conn.Write([]byte(fmt.Sprintf("HTTP/1.1 %d %s\r\nX-Scrapoxy-Proxyerror: %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n", status, code, reason)))
+}
+
+// dialErrorClass sorts the errors dialing the target into a few classes for the metrics.
+func dialErrorClass(err error) string {
+	var policyErr *utils.PolicyError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &policyErr):
+		return "denied"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "unreachable"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	default:
+		return "other"
 	}
 }
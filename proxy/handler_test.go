@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"proxy/utils"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// serveTestConn serves a single TLS connection with h, and returns the client side of it.
+func serveTestConn(t *testing.T, h Handler) *tls.Conn {
+	t.Helper()
+	ca := newTestCA(t, "proxy")
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{ca.cert.Raw}, PrivateKey: ca.key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if h.tracker == nil {
+			h.tracker = utils.NewConnTracker()
+		}
+		defer h.tracker.Track(conn)()
+		h.ServeConn(conn.(*tls.Conn))
+	}()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestHandler_ServeConn_badRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		status  int
+	}{
+		{
+			name:    "oversized header",
+			request: "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nX-Large: " + strings.Repeat("a", 16*1024) + "\r\n\r\n",
+			status:  http.StatusRequestHeaderFieldsTooLarge,
+		},
+		{
+			name:    "malformed request",
+			request: "NOT A REQUEST\r\n\r\n",
+			status:  http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := serveTestConn(t, Handler{headerTimeout: 5 * time.Second, maxHeaderBytes: 1024})
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			// The proxy may answer and close before the whole request is written.
+			go conn.Write([]byte(tt.request))
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("ServeConn() = %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
+
+func TestHandler_ServeConn_timeouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		closed  bool
+	}{
+		// A connection waiting for its first request only gets the keep-alive timeout.
+		{name: "idle", closed: false},
+		// A header started but never finished gets the header timeout.
+		{name: "slow header", request: "GET http://example.com/ HTTP/1.1\r\nHost: exa", closed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := serveTestConn(t, Handler{keepAliveTimeout: time.Second, headerTimeout: 100 * time.Millisecond, maxHeaderBytes: 1024})
+			if _, err := conn.Write([]byte(tt.request)); err != nil {
+				t.Fatal(err)
+			}
+
+			// The proxy closes a slow connection without answering.
+			conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			_, err := conn.Read(make([]byte, 1))
+			var netErr net.Error
+			timedOut := errors.As(err, &netErr) && netErr.Timeout()
+			if closed := errors.Is(err, io.EOF); closed != tt.closed || (!closed && !timedOut) {
+				t.Errorf("Read() = %v, want closed %v", err, tt.closed)
+			}
+		})
+	}
+}
+
+func TestHandler_ServeConn_drain(t *testing.T) {
+	tracker := utils.NewConnTracker()
+	conn := serveTestConn(t, Handler{tracker: tracker, keepAliveTimeout: time.Minute, headerTimeout: time.Second, maxHeaderBytes: 1024})
+	// The handshake completes once the server starts serving the connection.
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	for tracker.Len() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The connection waits for its next request, draining does not wait for it.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if closed := tracker.Drain(ctx); closed != 0 {
+		t.Errorf("Drain() = %d, want 0", closed)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Drain() took %s, want the idle connection closed right away", elapsed)
+	}
+	// The connection is closed, reset when the server had unread handshake data.
+	_, err := conn.Read(make([]byte, 1))
+	if !errors.Is(err, io.EOF) && !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Read() = %v, want the connection closed", err)
+	}
+}
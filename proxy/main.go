@@ -1,36 +1,186 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"crypto/tls"
-	"crypto/x509"
+	"errors"
 	"flag"
-	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"proxy/collector"
+	"proxy/utils"
+	"syscall"
+	"time"
+)
+
+var (
+	activeTunnelsGauge       prometheus.Gauge
+	handshakeCounter         *prometheus.CounterVec
+	certVerifyFailureCounter prometheus.Counter
+	upstreamDialErrorCounter *prometheus.CounterVec
+	upstreamDialHistogram    prometheus.Histogram
+	bytesReceivedCounter     prometheus.Counter
+	bytesSentCounter         prometheus.Counter
+	certificateReloadCounter *prometheus.CounterVec
+	handshakeFailureCounter  *prometheus.CounterVec
 )
 
 func main() {
 	addr := flag.String("addr", ":3128", "HTTPS network address")
 	certFile := flag.String("certfile", "certificate.pem", "certificate PEM file")
 	keyFile := flag.String("keyfile", "certificate.key", "key PEM file")
+	revocationFile := flag.String("revocationfile", "", "CRL or list of revoked serial numbers, in hexadecimal, of client certificates")
+	identities := flag.String("identities", "", "comma separated names one of which the client certificate must hold, any when empty")
+	watchCerts := flag.Bool("watchcerts", true, "reload the certificate when its files change, SIGHUP reloads it too")
+	metricAddr := flag.String("metricaddr", "", "Prometheus metrics network address, disabled when empty")
+	healthAddr := flag.String("healthaddr", "", "readiness probe network address, opt-in unlike the dispatcher as the proxy runs on instances exposed to the internet, disabled when empty")
+	handshakeTimeout := flag.Duration("handshaketimeout", 10*time.Second, "how long the TLS handshake may take, 0 to disable")
+	keepAliveTimeout := flag.Duration("keepalivetimeout", 60*time.Second, "how long a connection waits for its next request, longer than the connection pool idle timeout of the dispatcher, 0 to disable")
+	headerTimeout := flag.Duration("headertimeout", 10*time.Second, "how long reading a request header may take once started, 0 to disable")
+	maxHeaderBytes := flag.Int("maxheaderbytes", 64*1024, "maximum size of a request header")
+	shutdownTimeout := flag.Duration("shutdowntimeout", 30*time.Second, "how long open tunnels are drained on shutdown")
+	idleTimeout := flag.Duration("idletimeout", 10*time.Minute, "close tunnels without traffic for that long, 0 to disable")
+	maxDuration := flag.Duration("maxduration", 0, "close tunnels open for that long, 0 to disable")
+	dialTimeout := flag.Duration("dialtimeout", 60*time.Second, "how long connecting to a target may take, DNS resolution included, 0 to disable")
+	ipFamily := flag.String("ipfamily", FamilyAny, "address family of the targets: any, ipv4, ipv6, prefer-ipv4 or prefer-ipv6")
+	fallbackDelay := flag.Duration("fallbackdelay", 300*time.Millisecond, "how long the preferred address family is tried before the other one races it, negative to try the addresses one by one")
+	resolver := flag.String("resolver", "", "host:port of the DNS server, the system resolver when empty")
+	dnsCacheTTL := flag.Duration("dnscachettl", 30*time.Second, "how long resolved addresses are cached, 0 to disable")
+	sourceAddrs := flag.String("sourceaddrs", "", "comma separated local addresses of the upstream connections, the first of each family is the default and a CONNECT may pick another with the "+sourceAddressHeader+" header")
+	allowHosts := flag.String("allowhosts", "", "comma separated globs of the target hosts allowed, all when empty")
+	denyHosts := flag.String("denyhosts", "", "comma separated globs of the target hosts denied")
+	allowCIDRs := flag.String("allowcidrs", "", "comma separated CIDRs of the target addresses allowed, all when empty")
+	denyCIDRs := flag.String("denycidrs", "", "comma separated CIDRs of the target addresses denied")
+	allowPorts := flag.String("allowports", "", "comma separated target ports allowed, all when empty")
+	blockPrivate := flag.Bool("blockprivate", true, "deny private, loopback and link-local target addresses")
+	latencyBuckets := flag.String("latencybuckets", "", "comma separated buckets of the latency histograms in seconds")
 	flag.Parse()
 
-	caCert, err := os.ReadFile(*certFile)
+	ports, err := utils.ParsePorts(*allowPorts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	policy, err := utils.NewPolicy(utils.PolicyConfig{
+		AllowHosts:   utils.SplitList(*allowHosts),
+		DenyHosts:    utils.SplitList(*denyHosts),
+		AllowCIDRs:   utils.SplitList(*allowCIDRs),
+		DenyCIDRs:    utils.SplitList(*denyCIDRs),
+		AllowPorts:   ports,
+		BlockPrivate: *blockPrivate,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	sources, err := ParseAddrs(*sourceAddrs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dialer, err := NewDialer(DialerConfig{
+		Timeout:       *dialTimeout,
+		Family:        *ipFamily,
+		FallbackDelay: *fallbackDelay,
+		Resolver:      *resolver,
+		CacheTTL:      *dnsCacheTTL,
+		SourceAddrs:   sources,
+	}, policy)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	buckets, err := utils.ParseBuckets(*latencyBuckets, prometheus.DefBuckets)
 	if err != nil {
-		log.Fatal("Error opening cert file", certFile, ", error ", err)
+		log.Fatal(err)
 	}
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
-	cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+	activeTunnelsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "scrapoxy",
+		Subsystem: "proxy",
+		Name:      "active_tunnels",
+	})
+	handshakeCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "scrapoxy",
+		Subsystem: "proxy",
+		Name:      "handshakes_count",
+	}, []string{"result"})
+	handshakeFailureCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "scrapoxy",
+		Subsystem: "proxy",
+		Name:      "handshake_failures",
+	}, []string{"reason"})
+	certVerifyFailureCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "scrapoxy",
+		Subsystem: "proxy",
+		Name:      "cert_verify_failures",
+	})
+	upstreamDialErrorCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "scrapoxy",
+		Subsystem: "proxy",
+		Name:      "upstream_dial_errors",
+	}, []string{"class"})
+	upstreamDialHistogram = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "scrapoxy",
+		Subsystem: "proxy",
+		Name:      "upstream_dial_seconds",
+		Buckets:   buckets,
+	})
+	bytesReceivedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "scrapoxy",
+		Subsystem: "proxy",
+		Name:      "bytes_received",
+	})
+	bytesSentCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "scrapoxy",
+		Subsystem: "proxy",
+		Name:      "bytes_sent",
+	})
+	certificateReloadCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "scrapoxy",
+		Subsystem: "proxy",
+		Name:      "certificate_reloads",
+	}, []string{"result"})
+
+	certificates, err := NewCertificateStore(*certFile, *keyFile, *revocationFile, utils.SplitList(*identities))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *watchCerts {
+		if err = certificates.Watch(context.Background()); err != nil {
+			log.Fatal("Error watching certificate files: ", err)
+		}
+	}
+	hupSignal := make(chan os.Signal, 1)
+	signal.Notify(hupSignal, syscall.SIGHUP)
+	go func() {
+		for range hupSignal {
+			certificates.reloadAndLog()
+		}
+	}()
+
+	if *metricAddr != "" {
+		c := collector.Collector{
+			Namespace: "scrapoxy",
+			Subsystem: "proxy",
+			EnableCPU: true,
+			EnableMem: true,
+		}
+		prometheus.MustRegister(collector.NewPrometheusMetrics(c, NewCollector(certificates, "scrapoxy", "proxy")))
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		log.Printf("Starting metric server on %s", *metricAddr)
+		go http.ListenAndServe(*metricAddr, mux)
+	}
+
 	tlsConfig := &tls.Config{
-		MinVersion:   tls.VersionTLS13,
-		ClientAuth:   tls.RequireAnyClientCert,
-		ClientCAs:    caCertPool,
-		Certificates: []tls.Certificate{cert},
+		MinVersion: tls.VersionTLS13,
+		// The client certificate is verified against the current CA pool, which the
+		// ClientCAs of a static configuration could not follow.
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: certificates.VerifyPeerCertificate,
+		GetCertificate:        certificates.GetCertificate,
 	}
 
 	log.Printf("Starting server on %s", *addr)
@@ -40,31 +190,79 @@ func main() {
 	}
 	defer l.Close()
 
+	readiness := &utils.Readiness{}
+	tracker := utils.NewConnTracker()
+	transport := NewTransport(dialer)
+
+	if *healthAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/ready", readiness)
+		log.Printf("Starting health server on %s", *healthAddr)
+		go http.ListenAndServe(*healthAddr, mux)
+	}
+
+	signalCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go func() {
+		<-signalCtx.Done()
+		log.Printf("Draining connections for up to %s\n", *shutdownTimeout)
+		readiness.SetDraining()
+		l.Close()
+	}()
+
 	for {
 		conn, err := l.Accept()
 		if err != nil {
-			log.Fatal(err)
+			if readiness.Draining() {
+				break
+			}
+			log.Println(err)
+			continue
 		}
 		log.Printf("accepted connection from %s\n", conn.RemoteAddr())
 
 		go func(c net.Conn) {
-			scanner := bufio.NewScanner(c)
-			header := []byte{}
-			for scanner.Scan() {
-				line := scanner.Bytes()
-				header = append(header, fmt.Sprintf("%s\r\n", line)...)
-				if string(line) == "\r\n" || string(line) == "" {
-					break
+			defer tracker.Track(c)()
+			if *handshakeTimeout > 0 {
+				c.SetDeadline(time.Now().Add(*handshakeTimeout))
+			}
+			if err := c.(*tls.Conn).Handshake(); err != nil {
+				handshakeCounter.WithLabelValues("rejected").Inc()
+				reason := "handshake"
+				var certErr *CertificateError
+				if errors.As(err, &certErr) {
+					certVerifyFailureCounter.Inc()
+					reason = certErr.Reason
 				}
+				handshakeFailureCounter.WithLabelValues(reason).Inc()
+				log.Printf("TLS handshake with %s failed: %s\n", c.RemoteAddr(), err)
+				c.Close()
+				return
 			}
+			handshakeCounter.WithLabelValues("accepted").Inc()
+			c.SetDeadline(time.Time{})
 
-			req, _ := http.ReadRequest(bufio.NewReader(bytes.NewReader(header)))
+			h := Handler{
+				relayOptions: utils.RelayOptions{IdleTimeout: *idleTimeout, MaxDuration: *maxDuration},
+				transport:    transport,
+				policy:       policy,
+				dialer:       dialer,
+				tracker:      tracker,
 
-			h := Handler{caCertPool: caCertPool}
-			h.ServeRequest(req, c)
+				keepAliveTimeout: *keepAliveTimeout,
+				headerTimeout:    *headerTimeout,
+				maxHeaderBytes:   int64(*maxHeaderBytes),
+			}
+			h.ServeConn(c.(*tls.Conn))
 			c.Close()
 			log.Printf("closing connection from %s\n", conn.RemoteAddr())
 		}(conn)
 	}
 
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if closed := tracker.Drain(shutdownCtx); closed > 0 {
+		log.Printf("Closed %d tunnels still open after the shutdown timeout\n", closed)
+	}
+	log.Println("Proxy stopped")
 }
@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ParseBuckets parses comma separated histogram bucket boundaries, like "0.1,0.5,1". An
+// empty string returns def.
+func ParseBuckets(s string, def []float64) ([]float64, error) {
+	if strings.TrimSpace(s) == "" {
+		return def, nil
+	}
+	var buckets []float64
+	for _, part := range strings.Split(s, ",") {
+		bucket, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %q: %w", part, err)
+		}
+		buckets = append(buckets, bucket)
+	}
+	if !slices.IsSorted(buckets) {
+		return nil, fmt.Errorf("buckets %q are not sorted", s)
+	}
+	return buckets, nil
+}
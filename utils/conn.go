@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"bufio"
+	"net"
+)
+
+// BufferedConn is a net.Conn whose reads go through the bufio.Reader used to parse its
+// first bytes, so that the data read ahead of a header is not lost.
+type BufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func NewBufferedConn(conn net.Conn, reader *bufio.Reader) *BufferedConn {
+	return &BufferedConn{Conn: conn, reader: reader}
+}
+
+func (c *BufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// CloseWrite shuts down the writing side of the underlying connection when it supports it.
+func (c *BufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
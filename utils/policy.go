@@ -0,0 +1,198 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// PolicyConfig lists the rules of a Policy. Hosts are globs like "*.example.com", CIDRs
+// are prefixes like "10.0.0.0/8". Empty allow lists allow everything.
+type PolicyConfig struct {
+	AllowHosts   []string
+	DenyHosts    []string
+	AllowCIDRs   []string
+	DenyCIDRs    []string
+	AllowPorts   []int
+	BlockPrivate bool
+}
+
+// PolicyError is returned when a target is denied. Reason is meant for the client.
+type PolicyError struct {
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return "target denied: " + e.Reason
+}
+
+// cgnatPrefix is the shared address space of RFC 6598, not covered by netip.Addr.IsPrivate.
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// Policy decides which targets the tunnels may reach. The host names and ports are
+// checked before the DNS resolution, the addresses after it, so that a host name cannot
+// resolve to a denied address.
+type Policy struct {
+	allowHosts   []string
+	denyHosts    []string
+	allowCIDRs   []netip.Prefix
+	denyCIDRs    []netip.Prefix
+	allowPorts   []int
+	blockPrivate bool
+}
+
+func NewPolicy(config PolicyConfig) (*Policy, error) {
+	p := &Policy{
+		allowPorts:   config.AllowPorts,
+		blockPrivate: config.BlockPrivate,
+	}
+	for _, host := range config.AllowHosts {
+		p.allowHosts = append(p.allowHosts, strings.ToLower(host))
+	}
+	for _, host := range config.DenyHosts {
+		p.denyHosts = append(p.denyHosts, strings.ToLower(host))
+	}
+	var err error
+	if p.allowCIDRs, err = parsePrefixes(config.AllowCIDRs); err != nil {
+		return nil, err
+	}
+	if p.denyCIDRs, err = parsePrefixes(config.DenyCIDRs); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SplitList splits a comma separated list, ignoring the blanks.
+func SplitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// ParsePorts parses a comma separated list of ports.
+func ParsePorts(s string) ([]int, error) {
+	var ports []int
+	for _, item := range SplitList(s) {
+		port, err := strconv.Atoi(item)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q", item)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// CheckHost checks the host name and the port of a host:port target. When the host is
+// an IP address, the address is checked too.
+func (p *Policy) CheckHost(hostport string) error {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return &PolicyError{Reason: "invalid target " + hostport}
+	}
+	if err = p.checkPort(port); err != nil {
+		return err
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		// An address would bypass the allowed hosts, unless an allowed range covers it.
+		if len(p.allowHosts) > 0 && !containsAddr(p.allowCIDRs, addr.Unmap()) {
+			return &PolicyError{Reason: "address " + addr.String() + " is not allowed"}
+		}
+		return p.CheckAddr(addr)
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if matchHost(p.denyHosts, host) {
+		return &PolicyError{Reason: "host " + host + " is denied"}
+	}
+	if len(p.allowHosts) > 0 && !matchHost(p.allowHosts, host) {
+		return &PolicyError{Reason: "host " + host + " is not allowed"}
+	}
+	return nil
+}
+
+// CheckAddr checks an address the target resolved to.
+func (p *Policy) CheckAddr(addr netip.Addr) error {
+	addr = addr.Unmap()
+	if containsAddr(p.denyCIDRs, addr) {
+		return &PolicyError{Reason: "address " + addr.String() + " is denied"}
+	}
+	allowed := containsAddr(p.allowCIDRs, addr)
+	if len(p.allowCIDRs) > 0 && !allowed {
+		return &PolicyError{Reason: "address " + addr.String() + " is not allowed"}
+	}
+	// An explicitly allowed range overrides the private ranges block.
+	if p.blockPrivate && !allowed && isPrivate(addr) {
+		return &PolicyError{Reason: "address " + addr.String() + " is private"}
+	}
+	return nil
+}
+
+// Control checks the address a net.Dialer is about to connect to. Set it as the Control
+// of the dialer so that the check happens after the DNS resolution.
+func (p *Policy) Control(network, address string, c syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return &PolicyError{Reason: "invalid address " + address}
+	}
+	if err = p.checkPort(strconv.Itoa(int(addrPort.Port()))); err != nil {
+		return err
+	}
+	return p.CheckAddr(addrPort.Addr())
+}
+
+func (p *Policy) checkPort(port string) error {
+	if len(p.allowPorts) == 0 {
+		return nil
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || !slices.Contains(p.allowPorts, n) {
+		return &PolicyError{Reason: "port " + port + " is not allowed"}
+	}
+	return nil
+}
+
+func matchHost(globs []string, host string) bool {
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrivate tells whether the address is not routable on the internet: private,
+// loopback, link-local (like the cloud metadata endpoints), multicast or unspecified.
+func isPrivate(addr netip.Addr) bool {
+	return addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() || cgnatPrefix.Contains(addr)
+}
@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestPolicy_CheckHost(t *testing.T) {
+	policy, err := NewPolicy(PolicyConfig{
+		DenyHosts:    []string{"*.internal"},
+		AllowCIDRs:   []string{"10.1.0.0/16"},
+		DenyCIDRs:    []string{"203.0.113.0/24"},
+		AllowPorts:   []int{80, 443},
+		BlockPrivate: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostsPolicy, err := NewPolicy(PolicyConfig{
+		AllowHosts: []string{"*.example.com"},
+		AllowCIDRs: []string{"198.51.100.0/24"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		policy  *Policy
+		target  string
+		allowed bool
+	}{
+		{target: "example.com:443", allowed: true},
+		{target: "Example.com.:80", allowed: true},
+		{target: "example.com:22", allowed: false},
+		{target: "db.internal:443", allowed: false},
+		{target: "8.8.8.8:443", allowed: false},
+		{target: "10.1.2.3:443", allowed: true},
+		{target: "10.2.0.1:443", allowed: false},
+		{target: "169.254.169.254:80", allowed: false},
+		{target: "[::1]:80", allowed: false},
+		{target: "203.0.113.5:80", allowed: false},
+		{target: "example.com", allowed: false},
+		{policy: hostsPolicy, target: "www.example.com:443", allowed: true},
+		{policy: hostsPolicy, target: "other.com:443", allowed: false},
+		{policy: hostsPolicy, target: "8.8.8.8:443", allowed: false},
+		{policy: hostsPolicy, target: "[2001:4860:4860::8888]:443", allowed: false},
+		{policy: hostsPolicy, target: "198.51.100.7:443", allowed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			p := policy
+			if tt.policy != nil {
+				p = tt.policy
+			}
+			err := p.CheckHost(tt.target)
+			if tt.allowed && err != nil {
+				t.Errorf("CheckHost() = %v, want nil", err)
+			}
+			var policyErr *PolicyError
+			if !tt.allowed && !errors.As(err, &policyErr) {
+				t.Errorf("CheckHost() = %v, want a PolicyError", err)
+			}
+		})
+	}
+}
+
+func TestPolicy_Control(t *testing.T) {
+	policy, err := NewPolicy(PolicyConfig{BlockPrivate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// localhost passes the host check but resolves to a private address.
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	if err = policy.CheckHost("localhost:" + port); err != nil {
+		t.Fatalf("CheckHost() = %v, want nil", err)
+	}
+	dialer := &net.Dialer{Control: policy.Control}
+	_, err = dialer.Dial("tcp", "localhost:"+port)
+	var policyErr *PolicyError
+	if !errors.As(err, &policyErr) {
+		t.Errorf("Dial() = %v, want a PolicyError", err)
+	}
+}
@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrRelayIdle is reported when no data went through the relay for IdleTimeout.
+	ErrRelayIdle = errors.New("relay idle timeout")
+	// ErrRelayExpired is reported when the relay lasted longer than MaxDuration.
+	ErrRelayExpired = errors.New("relay max duration reached")
+)
+
+const relayBufferSize = 32 * 1024
+
+var relayBuffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, relayBufferSize)
+		return &b
+	},
+}
+
+type RelayOptions struct {
+	// IdleTimeout closes the relay when no data went through in either direction for that
+	// long. 0 disables it.
+	IdleTimeout time.Duration
+	// MaxDuration closes the relay after that long whatever the traffic. 0 disables it.
+	MaxDuration time.Duration
+	// OnFirstReceived is called when the first byte comes back from the upstream.
+	OnFirstReceived func()
+}
+
+// RelayStats reports what went through the relay. Sent is from the client to the
+// upstream, Received from the upstream to the client. The errors are nil when the
+// direction ended with EOF.
+type RelayStats struct {
+	Sent        int64
+	Received    int64
+	SentErr     error
+	ReceivedErr error
+}
+
+// Err returns the first error of the relay, if any.
+func (s RelayStats) Err() error {
+	if s.SentErr != nil {
+		return s.SentErr
+	}
+	return s.ReceivedErr
+}
+
+type relay struct {
+	opts         RelayOptions
+	lastActivity atomic.Int64
+	mutex        sync.Mutex
+	abortErr     error
+	conns        [2]net.Conn
+}
+
+// Relay copies data between client and upstream in both directions until both are done.
+// When one side stops sending, the other side is half-closed with CloseWrite when it
+// supports it, so that the peer sees the EOF while the other direction keeps flowing.
+// An error in one direction, or a timeout, aborts both directions. The connections are
+// not closed, this is left to the caller.
+func Relay(client, upstream net.Conn, opts RelayOptions) RelayStats {
+	r := &relay{opts: opts, conns: [2]net.Conn{client, upstream}}
+	r.touch()
+
+	if opts.MaxDuration > 0 {
+		timer := time.AfterFunc(opts.MaxDuration, func() {
+			r.abort(ErrRelayExpired)
+		})
+		defer timer.Stop()
+	}
+
+	var stats RelayStats
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		stats.Sent, stats.SentErr = r.copy(upstream, client, nil)
+	}()
+	stats.Received, stats.ReceivedErr = r.copy(client, upstream, opts.OnFirstReceived)
+	wg.Wait()
+	return stats
+}
+
+func (r *relay) touch() {
+	r.lastActivity.Store(time.Now().UnixNano())
+}
+
+// abort stops both directions by expiring their deadlines. The first reason is kept.
+func (r *relay) abort(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.abortErr != nil {
+		return
+	}
+	r.abortErr = err
+	past := time.Unix(1, 0)
+	for _, conn := range r.conns {
+		conn.SetDeadline(past)
+	}
+}
+
+func (r *relay) aborted() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.abortErr
+}
+
+func (r *relay) copy(dst, src net.Conn, onFirstByte func()) (int64, error) {
+	buf := relayBuffers.Get().(*[]byte)
+	defer relayBuffers.Put(buf)
+
+	var written int64
+	for {
+		if r.opts.IdleTimeout > 0 {
+			src.SetReadDeadline(time.Unix(0, r.lastActivity.Load()).Add(r.opts.IdleTimeout))
+		}
+		n, err := src.Read(*buf)
+		if n > 0 {
+			if written == 0 && onFirstByte != nil {
+				onFirstByte()
+			}
+			r.touch()
+			m, werr := dst.Write((*buf)[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, r.fail(werr)
+			}
+		}
+		if err == io.EOF {
+			closeWrite(dst)
+			return written, nil
+		}
+		if err != nil {
+			if abortErr := r.aborted(); abortErr != nil {
+				return written, abortErr
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && r.opts.IdleTimeout > 0 {
+				if time.Since(time.Unix(0, r.lastActivity.Load())) < r.opts.IdleTimeout {
+					// The other direction was active in the meantime.
+					continue
+				}
+				err = ErrRelayIdle
+			}
+			return written, r.fail(err)
+		}
+	}
+}
+
+// fail aborts the relay and returns the error that caused the abort.
+func (r *relay) fail(err error) error {
+	r.abort(err)
+	return r.aborted()
+}
+
+// closeWrite half-closes conn when it supports it, and closes it otherwise.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := <-accepted
+	t.Cleanup(func() {
+		dialed.Close()
+		conn.Close()
+	})
+	return dialed, conn
+}
+
+func TestRelay_halfClose(t *testing.T) {
+	client, clientPeer := tcpPair(t)
+	upstream, upstreamPeer := tcpPair(t)
+
+	done := make(chan RelayStats)
+	go func() {
+		done <- Relay(clientPeer, upstreamPeer, RelayOptions{IdleTimeout: time.Second})
+	}()
+
+	// The upstream answers only once the client is done sending, like an echo of the
+	// whole request.
+	go func() {
+		request, _ := io.ReadAll(upstream)
+		upstream.Write(append([]byte("echo "), request...))
+		upstream.(*net.TCPConn).CloseWrite()
+	}()
+
+	client.Write([]byte("hello"))
+	client.(*net.TCPConn).CloseWrite()
+	response, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "echo hello" {
+		t.Errorf("response = %q, want %q", response, "echo hello")
+	}
+
+	stats := <-done
+	if stats.Sent != 5 || stats.Received != 10 {
+		t.Errorf("Sent, Received = %d, %d, want 5, 10", stats.Sent, stats.Received)
+	}
+	if stats.Err() != nil {
+		t.Errorf("Err() = %v, want nil", stats.Err())
+	}
+}
+
+func TestRelay_idleTimeout(t *testing.T) {
+	_, clientPeer := tcpPair(t)
+	_, upstreamPeer := tcpPair(t)
+
+	start := time.Now()
+	stats := Relay(clientPeer, upstreamPeer, RelayOptions{IdleTimeout: 100 * time.Millisecond})
+	if stats.SentErr != ErrRelayIdle || stats.ReceivedErr != ErrRelayIdle {
+		t.Errorf("errors = %v, %v, want %v", stats.SentErr, stats.ReceivedErr, ErrRelayIdle)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Relay() took %s", elapsed)
+	}
+}
+
+func TestRelay_maxDuration(t *testing.T) {
+	client, clientPeer := tcpPair(t)
+	_, upstreamPeer := tcpPair(t)
+
+	// Keep the relay busy so that the idle timeout never triggers.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				client.Write([]byte("x"))
+			}
+		}
+	}()
+
+	stats := Relay(clientPeer, upstreamPeer, RelayOptions{IdleTimeout: 50 * time.Millisecond, MaxDuration: 200 * time.Millisecond})
+	if stats.Err() != ErrRelayExpired {
+		t.Errorf("Err() = %v, want %v", stats.Err(), ErrRelayExpired)
+	}
+	if stats.Sent == 0 {
+		t.Errorf("Sent = 0, want some bytes")
+	}
+}
@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Readiness reports whether the server accepts new work. It flips to not ready once the
+// server starts draining.
+type Readiness struct {
+	draining atomic.Bool
+}
+
+// SetDraining marks the server as not ready anymore.
+func (r *Readiness) SetDraining() {
+	r.draining.Store(true)
+}
+
+func (r *Readiness) Draining() bool {
+	return r.draining.Load()
+}
+
+// ServeHTTP answers 200 while the server is ready and 503 once it is draining.
+func (r *Readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.Draining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("draining\n"))
+		return
+	}
+	w.Write([]byte("ready\n"))
+}
+
+// ConnTracker keeps track of the connections in flight, like hijacked tunnels that
+// http.Server.Shutdown does not wait for, so they can be drained on shutdown. Like
+// http.Server, the connections idle between two requests are closed as soon as draining
+// starts instead of being waited for.
+type ConnTracker struct {
+	mutex    sync.Mutex
+	conns    map[net.Conn]bool
+	draining bool
+}
+
+func NewConnTracker() *ConnTracker {
+	return &ConnTracker{conns: make(map[net.Conn]bool)}
+}
+
+// Track registers conn, as active, until the returned function is called.
+func (t *ConnTracker) Track(conn net.Conn) func() {
+	t.mutex.Lock()
+	t.conns[conn] = false
+	t.mutex.Unlock()
+	return func() {
+		t.mutex.Lock()
+		delete(t.conns, conn)
+		t.mutex.Unlock()
+	}
+}
+
+// SetIdle marks conn as waiting for its next request, or as active again. An idle
+// connection is closed right away while draining. It returns false when conn was closed
+// by the draining, the caller must then stop serving it.
+func (t *ConnTracker) SetIdle(conn net.Conn, idle bool) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.conns[conn]; !ok {
+		return false
+	}
+	if idle && t.draining {
+		conn.Close()
+		delete(t.conns, conn)
+		return false
+	}
+	t.conns[conn] = idle
+	return true
+}
+
+// Len returns the number of connections in flight.
+func (t *ConnTracker) Len() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.conns)
+}
+
+// Drain closes the idle connections and waits for the active ones to finish. When ctx is
+// done first, the remaining connections are closed and their number is returned.
+func (t *ConnTracker) Drain(ctx context.Context) int {
+	t.mutex.Lock()
+	t.draining = true
+	for conn, idle := range t.conns {
+		if idle {
+			conn.Close()
+			delete(t.conns, conn)
+		}
+	}
+	t.mutex.Unlock()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for t.Len() > 0 {
+		select {
+		case <-ctx.Done():
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			closed := len(t.conns)
+			for conn := range t.conns {
+				conn.Close()
+			}
+			return closed
+		case <-ticker.C:
+		}
+	}
+	return 0
+}
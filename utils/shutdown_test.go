@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+	r := &Readiness{}
+	for _, want := range []int{http.StatusOK, http.StatusServiceUnavailable} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		if w.Code != want {
+			t.Errorf("ServeHTTP() = %d, want %d", w.Code, want)
+		}
+		r.SetDraining()
+	}
+	if !r.Draining() {
+		t.Errorf("Draining() = false, want true")
+	}
+}
+
+// isClosed tells whether conn was closed on our side.
+func isClosed(conn net.Conn) bool {
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := conn.Write([]byte{0})
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return err != nil
+}
+
+func TestConnTracker_Drain(t *testing.T) {
+	tests := []struct {
+		name string
+		// idle marks the connection idle, release ends it after that delay when set.
+		idle    bool
+		release time.Duration
+		timeout time.Duration
+		closed  int
+		// waits tells whether Drain waits for the connection to end.
+		waits bool
+	}{
+		{name: "idle", idle: true, timeout: time.Second},
+		{name: "active", release: 200 * time.Millisecond, timeout: time.Second, waits: true},
+		{name: "timeout", timeout: 200 * time.Millisecond, closed: 1, waits: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := NewConnTracker()
+			conn, other := net.Pipe()
+			defer other.Close()
+			release := tracker.Track(conn)
+			if !tracker.SetIdle(conn, tt.idle) {
+				t.Fatalf("SetIdle() = false before draining")
+			}
+			if tt.release > 0 {
+				time.AfterFunc(tt.release, release)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			start := time.Now()
+			if closed := tracker.Drain(ctx); closed != tt.closed {
+				t.Errorf("Drain() = %d, want %d", closed, tt.closed)
+			}
+			if waited := time.Since(start) >= 150*time.Millisecond; waited != tt.waits {
+				t.Errorf("Drain() waited %s, want waiting %v", time.Since(start), tt.waits)
+			}
+			if tt.release == 0 && !isClosed(conn) {
+				t.Errorf("connection is still open")
+			}
+		})
+	}
+}
+
+func TestConnTracker_SetIdle(t *testing.T) {
+	tracker := NewConnTracker()
+	conn, other := net.Pipe()
+	defer other.Close()
+	defer tracker.Track(conn)()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go tracker.Drain(ctx)
+	for draining := false; !draining; time.Sleep(time.Millisecond) {
+		tracker.mutex.Lock()
+		draining = tracker.draining
+		tracker.mutex.Unlock()
+	}
+
+	// An active connection going idle while draining is closed.
+	if tracker.SetIdle(conn, true) {
+		t.Errorf("SetIdle() = true while draining, want false")
+	}
+	if !isClosed(conn) {
+		t.Errorf("connection is still open")
+	}
+}